@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"zfs-unlocker/internal/client"
+)
+
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// serverList collects repeated --server flags; each may also hold a
+// comma-separated list.
+type serverList []string
+
+func (s *serverList) String() string { return strings.Join(*s, ",") }
+
+func (s *serverList) Set(v string) error {
+	for u := range strings.SplitSeq(v, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			*s = append(*s, u)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var servers serverList
+	flag.Var(&servers, "server", "zfs-unlocker base URL; repeat or separate with commas to fail over")
+	keyFile := flag.String("key-file", "/etc/zfs-unlocker/client.key", "File holding the API key (mode 0600)")
+	caFile := flag.String("ca-file", "", "CA bundle to verify the server's certificate")
+	zfsPath := flag.String("zfs", "zfs", "Path to the zfs executable")
+	attempts := flag.Int("attempts", client.DefaultAttempts, "Rounds over all servers before giving up")
+	backoff := flag.Duration("backoff", client.DefaultBackoff, "Wait after the first failed round, doubled after each")
+	maxBackoff := flag.Duration("max-backoff", client.DefaultMaxBackoff, "Longest wait between rounds")
+	timeout := flag.Duration("timeout", client.DefaultTimeout, "Per-attempt timeout against a server, including the wait for approval")
+	versionFlag := flag.Bool("version", false, "Print version information")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: zfs-unlocker-client --server URL [flags] dataset[=volume-id]...\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *versionFlag {
+		fmt.Printf("zfs-unlocker-client %s\n", version)
+		return
+	}
+	if len(servers) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var targets []client.Target
+	for _, arg := range flag.Args() {
+		t, err := client.ParseTarget(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets = append(targets, t)
+	}
+
+	apiKey, err := client.ReadKeyFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read API key: %v", err)
+	}
+	httpClient, err := newHTTPClient(*caFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := &client.Client{
+		Servers:    servers,
+		APIKey:     apiKey,
+		HTTP:       httpClient,
+		Attempts:   *attempts,
+		Backoff:    *backoff,
+		MaxBackoff: *maxBackoff,
+		Timeout:    *timeout,
+	}
+	if err := client.Unlock(ctx, c, client.ZFS{Path: *zfsPath}, targets); err != nil {
+		log.Fatalf("Unlock failed: %v", err)
+	}
+}
+
+func newHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{}, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/config"
+)
+
+// runAudit implements the "audit" subcommand and returns the exit code.
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: zfs-unlocker audit verify [--config config.yaml] [--file audit.log]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	file := fs.String("file", "", "Path to the audit log (defaults to audit.path from the config)")
+	fs.Parse(args[1:])
+
+	path := *file
+	if path == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		path = cfg.Audit.Path
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No audit log configured; set audit.path or pass --file")
+		return 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	n, err := audit.Verify(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log %s failed verification after %d valid records: %v\n", path, n, err)
+		return 1
+	}
+	fmt.Printf("Audit log %s OK: %d records verified\n", path, n)
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/policy"
+)
+
+// runConfig implements the "config" subcommand and returns the exit code.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: zfs-unlocker config check [--config config.yaml]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	fs.Parse(args[1:])
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	// Auto-approve rules are compiled outside the config package, so they
+	// are checked here rather than in config.Validate.
+	if _, err := policy.New(cfg.AutoApprove); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: OK (%d API keys)\n", *configPath, len(cfg.ApiKeys))
+	return 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"zfs-unlocker/internal/apikey"
+)
+
+// runKeys implements the "keys" subcommand and returns the exit code.
+func runKeys(args []string) int {
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, "Usage: zfs-unlocker keys generate [--hash argon2id|bcrypt|sha256]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	alg := fs.String("hash", apikey.Argon2id, "Hash algorithm: argon2id, bcrypt or sha256")
+	fs.Parse(args[1:])
+
+	id, key, err := apikey.GenerateWithID()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	hash, err := apikey.Hash(*alg, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("API key (give to the client): %s\n", key)
+	fmt.Printf("Config entry:\n  key_id: '%s'\n  key_hash: '%s'\n", id, hash)
+	return 0
+}
@@ -1,20 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"zfs-unlocker/internal/api"
 	"zfs-unlocker/internal/approval"
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/backend"
 	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/health"
+	"zfs-unlocker/internal/metrics"
+	"zfs-unlocker/internal/policy"
 	"zfs-unlocker/internal/telegram"
-	"zfs-unlocker/internal/vault"
 
 	"github.com/gin-gonic/gin"
 )
 
+// shutdownTimeout bounds how long in-flight HTTP requests are drained on exit.
+const shutdownTimeout = 15 * time.Second
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -22,6 +38,18 @@ var (
 )
 
 func main() {
+	// Subcommands take their own flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "audit":
+			os.Exit(runAudit(os.Args[2:]))
+		case "keys":
+			os.Exit(runKeys(os.Args[2:]))
+		}
+	}
+
 	// Parse flags manually or using flag package.
 	versionFlag := flag.Bool("version", false, "Print version information")
 	vFlag := flag.Bool("v", false, "Print version information")
@@ -32,34 +60,109 @@ func main() {
 		fmt.Printf("zfs-unlocker %s\n", version)
 		os.Exit(0)
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// 1. Load Config
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// 2. Initialize Vault
-	vaultSvc, err := vault.New(cfg.Vault)
+	// Open the audit log before anything can generate events.
+	var auditLog *audit.Logger
+	if cfg.Audit.Path != "" {
+		auditLog, err = audit.Open(cfg.Audit.Path)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+	}
+
+	// 2. Initialize the secret backend (Vault unless configured otherwise)
+	vaultSvc, err := backend.New(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize Vault service: %v", err)
+		log.Fatalf("Failed to initialize secret backend: %v", err)
+	}
+	if closer, ok := vaultSvc.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+
+	var metricsReg *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		metricsReg = metrics.New()
 	}
 
 	// 3. Initialize Approval Service
-	approvalSvc := approval.New()
+	approvalOpts := []approval.Option{
+		approval.WithAuditLog(auditLog),
+		approval.WithDefaultTimeout(cfg.Server.ApprovalTimeout),
+		approval.WithMetrics(metricsReg),
+	}
+	if cfg.Storage.Path != "" {
+		store, err := approval.OpenBoltStore(cfg.Storage.Path)
+		if err != nil {
+			log.Fatalf("Failed to open request store: %v", err)
+		}
+		defer store.Close()
+		approvalOpts = append(approvalOpts, approval.WithStore(store))
+	}
+	approvalSvc := approval.New(approvalOpts...)
+	stale, err := approvalSvc.Restore()
+	if err != nil {
+		log.Fatalf("Failed to restore approval requests: %v", err)
+	}
 
 	// 4. Initialize Telegram Bot
-	botSvc, err := telegram.New(cfg.Telegram, approvalSvc)
+	botOpts := []telegram.Option{
+		telegram.WithAuditLog(auditLog),
+		telegram.WithVersion(version),
+		telegram.WithMetrics(metricsReg),
+	}
+	if hc, ok := vaultSvc.(interface{ AuthHealth() error }); ok {
+		botOpts = append(botOpts, telegram.WithHealthCheck(hc.AuthHealth))
+	}
+	botSvc, err := telegram.New(cfg.Telegram, approvalSvc, botOpts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize Telegram bot: %v", err)
 	}
+	botSvc.ReconcileStale(stale)
 	botSvc.Start()
 
 	// 5. Initialize API
-	apiHandler := api.New(cfg.ApiKeys, approvalSvc, vaultSvc, botSvc)
+	autoApprove, err := policy.New(cfg.AutoApprove)
+	if err != nil {
+		log.Fatalf("Failed to load auto-approve rules: %v", err)
+	}
+	apiHandler := api.New(cfg.ApiKeys, approvalSvc, vaultSvc, botSvc,
+		api.WithAuditLog(auditLog),
+		api.WithLegacyPathAuth(cfg.Server.LegacyPathAuth),
+		api.WithAutoApprove(autoApprove),
+		api.WithRateLimit(cfg.Server.RateLimit),
+		api.WithMetrics(metricsReg),
+	)
+
+	// Pick up API key and Telegram changes on SIGHUP or when the file is edited.
+	go watchConfig(ctx, *configPath, cfg, apiHandler, autoApprove, botSvc)
 
 	// 6. Setup Router
-	r := gin.Default()
+	r, err := api.NewRouter(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 	apiHandler.RegisterRoutes(r)
+	if metricsReg != nil && cfg.Metrics.ListenAddress == "" {
+		r.GET("/metrics", gin.WrapH(metricsReg.Handler()))
+	}
+
+	// Readiness covers what an unlock needs: the secret backend and Telegram.
+	checker := health.New()
+	if p, ok := vaultSvc.(interface{ Ping(context.Context) error }); ok {
+		checker.Add("vault", p.Ping)
+	}
+	checker.Add("telegram", botSvc.Ping)
+	r.GET("/healthz", gin.WrapF(checker.Healthz))
+	r.GET("/readyz", gin.WrapF(checker.Readyz))
 
 	// 7. Run Server
 	addr := cfg.Server.ListenAddress
@@ -68,13 +171,134 @@ func main() {
 	}
 	log.Printf("Starting server on %s", addr)
 
-	if cfg.Server.CertFile != "" && cfg.Server.KeyFile != "" {
-		if err := r.RunTLS(addr, cfg.Server.CertFile, cfg.Server.KeyFile); err != nil {
-			log.Fatalf("Server failed to start (TLS): %v", err)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+
+	// Shutdown closes the listeners before running this, so no new requests
+	// arrive while the pending ones are cancelled and their waiters answered.
+	// With a persistent store they are only suspended instead, so they are
+	// restored and can still be decided after a restart.
+	cancelled := make(chan []approval.Request, 1)
+	srv.RegisterOnShutdown(func() {
+		if cfg.Storage.Path != "" {
+			approvalSvc.Suspend()
+			cancelled <- nil
+			return
 		}
-	} else {
-		if err := r.Run(addr); err != nil {
-			log.Fatalf("Server failed: %v", err)
+		cancelled <- approvalSvc.CancelAll()
+	})
+
+	serveErr := make(chan error, 2)
+
+	// Metrics may be served on their own listener, e.g. reachable only from
+	// the monitoring network.
+	var metricsSrv *http.Server
+	if metricsReg != nil && cfg.Metrics.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsReg.Handler())
+		metricsSrv = &http.Server{Addr: cfg.Metrics.ListenAddress, Handler: mux}
+		log.Printf("Serving metrics on %s", cfg.Metrics.ListenAddress)
+		go func() {
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- fmt.Errorf("metrics listener: %w", err)
+			}
+		}()
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	go func() {
+		if cfg.Server.CertFile != "" && cfg.Server.KeyFile != "" {
+			if cfg.Server.ClientCAFile != "" {
+				tlsCfg, err := clientAuthTLSConfig(cfg.Server.ClientCAFile)
+				if err != nil {
+					serveErr <- fmt.Errorf("failed to configure client certificate authentication: %w", err)
+					return
+				}
+				srv.TLSConfig = tlsCfg
+			}
+			serveErr <- srv.ServeTLS(ln, cfg.Server.CertFile, cfg.Server.KeyFile)
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+
+	// Tell systemd (Type=notify) we are listening, and keep its watchdog fed
+	// while the approval service and its store still respond. Vault and
+	// Telegram are left out: a restart would not bring them back.
+	sdNotify("READY=1")
+	if interval := health.WatchdogInterval(); interval > 0 {
+		liveness := health.New()
+		liveness.Timeout = min(health.DefaultTimeout, interval/4)
+		liveness.CacheFor = interval / 4
+		liveness.Add("approval", approvalSvc.Ping)
+		go feedWatchdog(ctx, interval/2, liveness)
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	// 8. Shut down: drain HTTP requests, cancel pending approvals, stop the bot.
+	log.Printf("Shutting down")
+	sdNotify("STOPPING=1")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(shutdownCtx)
+	}
+	botSvc.ReconcileCancelled(<-cancelled)
+	botSvc.Stop(shutdownCtx)
+	log.Printf("Shutdown complete")
+}
+
+func sdNotify(state string) {
+	if err := health.SdNotify(state); err != nil {
+		log.Printf("Failed to notify systemd (%s): %v", state, err)
+	}
+}
+
+// feedWatchdog pings the systemd watchdog until ctx is cancelled, as long as
+// the liveness checks pass, so a hung process gets restarted.
+func feedWatchdog(ctx context.Context, every time.Duration, liveness *health.Checker) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if report := liveness.Run(ctx); report.Status != "ok" {
+				log.Printf("Liveness check failed, not feeding the watchdog: %+v", report.Checks)
+				continue
+			}
+			sdNotify("WATCHDOG=1")
 		}
 	}
 }
+
+// clientAuthTLSConfig verifies client certificates against the given CA bundle
+// when clients present one; clients may still authenticate with a bearer key.
+func clientAuthTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
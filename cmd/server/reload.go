@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"zfs-unlocker/internal/api"
+	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/policy"
+	"zfs-unlocker/internal/telegram"
+)
+
+// watchConfig applies changes to the config file to the running server until
+// ctx is cancelled. API keys, auto-approve rules and Telegram chat/user
+// settings are swapped in place; everything else is only read at startup.
+func watchConfig(ctx context.Context, path string, started *config.Config, apiHandler *api.Handler, autoApprove *policy.Engine, botSvc *telegram.Bot) {
+	// Each restart-only change is warned about once, by the reload that made it.
+	applied := started
+	w := &config.Watcher{
+		Path: path,
+		Apply: func(cfg *config.Config) error {
+			// Compile everything before swapping anything, so a rejected
+			// file never leaves a mix of old and new settings in effect.
+			rules, err := policy.Compile(cfg.AutoApprove)
+			if err != nil {
+				return err
+			}
+			keys, err := api.CompileRules(cfg.ApiKeys)
+			if err != nil {
+				return err
+			}
+			autoApprove.Swap(rules)
+			apiHandler.SwapRules(keys)
+			botSvc.Reload(cfg.Telegram)
+			if changed := restartRequired(applied, cfg); len(changed) > 0 {
+				log.Printf("Warning: changes to %s take effect after a restart", strings.Join(changed, ", "))
+			}
+			applied = cfg
+			return nil
+		},
+		Report: func(err error) {
+			text := "🔄 Configuration reloaded"
+			if err != nil {
+				log.Printf("Rejected new configuration, keeping the current one: %v", err)
+				text = fmt.Sprintf("⚠️ Configuration reload failed, keeping the current configuration:\n%v", err)
+			} else {
+				log.Printf("Configuration reloaded from %s", path)
+			}
+			if err := botSvc.Notify(text); err != nil {
+				log.Printf("Failed to announce configuration reload: %v", err)
+			}
+		},
+	}
+	w.Run(ctx)
+}
+
+// restartRequired lists the config sections that differ from the previously
+// applied configuration but cannot be applied while running.
+func restartRequired(old, cfg *config.Config) []string {
+	var changed []string
+	sections := []struct {
+		name     string
+		old, new any
+	}{
+		{"server", old.Server, cfg.Server},
+		{"storage", old.Storage, cfg.Storage},
+		{"audit", old.Audit, cfg.Audit},
+		{"metrics", old.Metrics, cfg.Metrics},
+		{"backend", old.Backend, cfg.Backend},
+		{"vault", old.Vault, cfg.Vault},
+		{"telegram.bot_token", old.Telegram.BotToken, cfg.Telegram.BotToken},
+	}
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
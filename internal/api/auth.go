@@ -0,0 +1,255 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"zfs-unlocker/internal/apikey"
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CertMatch maps a verified TLS client certificate to a client rule.
+// Every non-empty field must match.
+type CertMatch struct {
+	Subject    string // common name or full distinguished name
+	DNSName    string // DNS subject alternative name
+	SPKISHA256 string // hex SHA-256 fingerprint of the public key
+}
+
+func (m *CertMatch) matches(cert *x509.Certificate) bool {
+	if m.Subject != "" && cert.Subject.CommonName != m.Subject && cert.Subject.String() != m.Subject {
+		return false
+	}
+	if m.DNSName != "" && !slices.Contains(cert.DNSNames, m.DNSName) {
+		return false
+	}
+	if m.SPKISHA256 != "" {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), m.SPKISHA256) {
+			return false
+		}
+	}
+	return true
+}
+
+func certMatchFromConfig(c config.ClientCertMatch) *CertMatch {
+	if c == (config.ClientCertMatch{}) {
+		return nil
+	}
+	return &CertMatch{
+		Subject:    c.Subject,
+		DNSName:    c.DNSName,
+		SPKISHA256: strings.ReplaceAll(c.SPKISHA256, ":", ""),
+	}
+}
+
+// ruleName returns the name identifying an API key entry in request records
+// and logs. Unnamed entries get a name derived from a fingerprint of their
+// credential, so the key itself is never written anywhere.
+func ruleName(k config.APIKey) string {
+	switch {
+	case k.Name != "":
+		return k.Name
+	case k.Key != "":
+		sum := sha256.Sum256([]byte(k.Key))
+		return "key-" + hex.EncodeToString(sum[:4])
+	case k.KeyHash != "":
+		sum := sha256.Sum256([]byte(k.KeyHash))
+		return "key-" + hex.EncodeToString(sum[:4])
+	default:
+		sum := sha256.Sum256(fmt.Appendf(nil, "%+v", k.ClientCert))
+		return "cert-" + hex.EncodeToString(sum[:4])
+	}
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// verifiedClientCert returns the client certificate if the TLS layer verified it.
+func verifiedClientCert(c *gin.Context) *x509.Certificate {
+	tlsState := c.Request.TLS
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 || len(tlsState.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsState.PeerCertificates[0]
+}
+
+// authenticate finds the client rule for a request. The API key is taken from
+// the path on legacy routes, otherwise from the Authorization header, with a
+// verified client certificate as the last resort.
+func (h *Handler) authenticate(c *gin.Context) (*ClientRule, string) {
+	apiKey := c.Param("apiKey")
+	if apiKey == "" {
+		apiKey = bearerToken(c)
+	}
+	if apiKey != "" {
+		if rule := h.ruleForKey(apiKey); rule != nil {
+			return rule, ""
+		}
+		return nil, "unknown key"
+	}
+
+	if cert := verifiedClientCert(c); cert != nil {
+		for _, rule := range h.rules.Load().certRules {
+			if rule.Cert.matches(cert) {
+				return rule, ""
+			}
+		}
+		return nil, fmt.Sprintf("unknown client certificate %q", cert.Subject.String())
+	}
+	return nil, "missing key"
+}
+
+// ruleForKey finds the rule whose configured key or key hash matches apiKey.
+// Every candidate is compared in constant time; successful hash
+// verifications are cached since argon2id and bcrypt are deliberately slow.
+// A key whose ID names a configured key_id is only checked against that
+// entry's hash, and slow hashes are only checked for keys carrying their ID,
+// so unknown keys cannot make the server run any slow hash.
+func (h *Handler) ruleForKey(apiKey string) *ClientRule {
+	rs := h.rules.Load()
+	digest := sha256.Sum256([]byte(apiKey))
+	if rule, ok := rs.verifiedKeys.Load(digest); ok {
+		return rule.(*ClientRule)
+	}
+
+	var match *ClientRule
+	for _, rule := range rs.keyRules {
+		if rule.keyDigest != nil && subtle.ConstantTimeCompare(rule.keyDigest, digest[:]) == 1 && match == nil {
+			match = rule
+		}
+	}
+	if match != nil {
+		return match
+	}
+
+	byID, hasID := rs.keyIDs[apikey.ID(apiKey)]
+	for _, rule := range rs.keyRules {
+		// Entries with a key ID are only checked for keys carrying it.
+		if rule.keyHash == "" || (hasID && rule != byID) || (!hasID && (rule.keyID != "" || apikey.IsSlow(rule.keyHash))) {
+			continue
+		}
+		ok, err := apikey.Verify(rule.keyHash, apiKey)
+		if err != nil {
+			log.Printf("Invalid key hash for API key %s: %v", rule.Name, err)
+			continue
+		}
+		if ok {
+			rs.verifiedKeys.Store(digest, rule)
+			return rule
+		}
+	}
+	return nil
+}
+
+func (h *Handler) authMiddleware(c *gin.Context) {
+	rule, reason := h.authenticate(c)
+	if rule == nil {
+		h.recordAuthFailure(c, "", reason)
+		if reason == "missing key" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing key parameter"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check IP restrictions
+	if len(rule.AllowedNets) > 0 {
+		clientIPStr := c.ClientIP()
+		clientIP := net.ParseIP(clientIPStr)
+
+		if clientIP == nil {
+			h.recordAuthFailure(c, rule.Name, "invalid client IP")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid IP"})
+			return
+		}
+
+		allowed := false
+		for _, network := range rule.AllowedNets {
+			if network.Contains(clientIP) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			log.Printf("Access denied for key %s from IP %s", rule.Name, clientIPStr)
+			h.recordAuthFailure(c, rule.Name, "IP not allowed")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "IP not allowed"})
+			return
+		}
+	}
+
+	if !h.limiter.allowKey(rule.Name) {
+		tooManyRequests(c, 0)
+		return
+	}
+
+	// Store rule info in context for the handler
+	c.Set("keyName", rule.Name)
+	c.Set("clientRule", rule)
+	c.Next()
+}
+
+func (h *Handler) recordAuthFailure(c *gin.Context, keyName, reason string) {
+	h.auditLog.Record(audit.Event{
+		Type:     audit.EventAuthFailed,
+		APIKey:   keyName,
+		VolumeID: c.Param("volumeID"),
+		ClientIP: c.ClientIP(),
+		Detail:   reason,
+	})
+	h.recordProbe(c, keyName, reason)
+}
+
+// NewRouter returns an engine like gin.Default(), but keeping API keys in
+// legacy paths out of the access log. X-Forwarded-For is only believed from
+// trustedProxies (IPs or CIDRs); with none, the connection's address is the
+// client address that rate limits and allowed_cidrs see.
+func NewRouter(trustedProxies []string) (*gin.Engine, error) {
+	r := gin.New()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, err
+	}
+	r.Use(gin.LoggerWithFormatter(LogFormatter), gin.Recovery())
+	return r, nil
+}
+
+// LogFormatter is gin's access log format with API keys in legacy
+// /unlock/:apiKey/:volumeID paths redacted.
+func LogFormatter(param gin.LogFormatterParams) string {
+	path := param.Path
+	if rest, ok := strings.CutPrefix(path, "/unlock/"); ok {
+		if _, volume, found := strings.Cut(rest, "/"); found {
+			path = "/unlock/REDACTED/" + volume
+		}
+	}
+
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		path,
+		param.ErrorMessage,
+	)
+}
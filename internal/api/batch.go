@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"zfs-unlocker/internal/approval"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchVolumes caps the number of volumes in one batch request; every
+// volume gets a toggle button in the Telegram message.
+const maxBatchVolumes = 20
+
+type batchUnlockBody struct {
+	Volumes []string `json:"volumes" binding:"required,min=1,dive,required"`
+}
+
+type batchUnlockResponse struct {
+	ID       string            `json:"id"`
+	Status   approval.Status   `json:"status"`
+	Keys     map[string][]byte `json:"keys,omitempty"`     // volume ID -> key, base64 encoded in JSON
+	Excluded []string          `json:"excluded,omitempty"` // volumes the approvers left out
+}
+
+// handleBatchUnlock asks for a single approval covering several volumes and
+// returns the keys of the volumes the approvers selected.
+func (h *Handler) handleBatchUnlock(c *gin.Context) {
+	ruleObj, _ := c.Get("clientRule")
+	rule := ruleObj.(*ClientRule)
+
+	var body batchUnlockBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing volumes"})
+		return
+	}
+	volumes, msg := batchVolumes(body.Volumes)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	reqID, waitChan, err := h.startBatch(c, rule, volumes, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send approval request"})
+		return
+	}
+
+	approved, ok := h.awaitDecision(c, reqID, waitChan)
+	if !ok {
+		return
+	}
+	req, _ := h.approvalService.Get(reqID)
+	if !approved {
+		switch req.Status {
+		case approval.StatusExpired:
+			c.JSON(http.StatusGatewayTimeout, gin.H{"status": "timeout"})
+		case approval.StatusCancelled, approval.StatusPending: // still pending: suspended for a restart
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "cancelled"})
+		default:
+			c.JSON(http.StatusForbidden, gin.H{"status": "denied"})
+		}
+		return
+	}
+
+	keys, err := h.batchKeys(c.Request.Context(), rule, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Approved, but " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, batchUnlockResponse{ID: req.ID, Status: req.Status, Keys: keys, Excluded: req.Excluded})
+}
+
+// batchVolumes validates and deduplicates the volumes of a batch request. For
+// an invalid list it returns the message to answer 400 with.
+func batchVolumes(ids []string) ([]string, string) {
+	if !validVolumeIDs(ids) {
+		return nil, "Invalid volume ID"
+	}
+	volumes := slices.Compact(slices.Sorted(slices.Values(ids)))
+	if len(volumes) > maxBatchVolumes {
+		return nil, fmt.Sprintf("At most %d volumes per request", maxBatchVolumes)
+	}
+	return volumes, ""
+}
+
+// startBatch creates one approval request covering volumes and sends it to the approvers.
+// Like startRequest, it keeps blocking and two-phase requests apart.
+func (h *Handler) startBatch(c *gin.Context, rule *ClientRule, volumes []string, twoPhase bool) (string, <-chan bool, error) {
+	// The longest timeout of the volumes applies to the whole batch.
+	var timeout time.Duration
+	for _, v := range volumes {
+		timeout = max(timeout, rule.approvalTimeout(v))
+	}
+	return h.submit(approval.Request{
+		TwoPhase:    twoPhase,
+		VolumeID:    strings.Join(volumes, ","),
+		Volumes:     volumes,
+		APIKey:      c.GetString("keyName"),
+		ClientIP:    c.ClientIP(),
+		Description: fmt.Sprintf("Request to unlock %d volumes", len(volumes)),
+		Policy:      rule.Policy,
+		Timeout:     timeout,
+	})
+}
+
+// batchKeys fetches the keys of the volumes an approved batch request covers.
+// The error names the failing volume and is safe to show to the client.
+func (h *Handler) batchKeys(ctx context.Context, rule *ClientRule, req approval.Request) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, volumeID := range req.SelectedVolumes() {
+		// Each volume is fetched like a single request, with its own pinned version.
+		single := req
+		single.VolumeID = volumeID
+		single.Version = rule.secretVersion(volumeID, 0)
+		secret, err := h.fetchSecret(ctx, rule, single)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch secret for %s", volumeID)
+		}
+		key, found, err := decodeKey(secret, rule.keyFormat(volumeID, secret))
+		if err != nil || !found {
+			log.Printf("No usable key for %s in request %s: %v", volumeID, req.ID, err)
+			return nil, fmt.Errorf("failed to decode key for %s", volumeID)
+		}
+		keys[volumeID] = key
+	}
+	return keys, nil
+}
@@ -1,111 +1,238 @@
 package api
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"zfs-unlocker/internal/approval"
+	"zfs-unlocker/internal/audit"
 	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/metrics"
+	"zfs-unlocker/internal/policy"
 	"zfs-unlocker/internal/vault"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ClientRule struct {
+	Name        string     // identifies the key in request records and logs
+	Cert        *CertMatch // client certificate mapped to this rule, if any
+	keyDigest   []byte     // SHA-256 of a plaintext key from config
+	keyHash     string     // argon2id/bcrypt/sha256 hash of the key from config
+	keyID       string     // ID prefix of keys checked against keyHash, if configured
 	AllowedNets []*net.IPNet
 	PathPrefix  string
+	Policy      approval.Policy
+	Timeout     time.Duration // approval timeout for the key; the server default if zero
+	Volumes     map[string]config.VolumeConfig
+}
+
+// secretVersion returns the version requested by the client, falling back
+// to the version pinned for the volume in config (0 meaning latest).
+func (r *ClientRule) secretVersion(volumeID string, requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	return r.Volumes[volumeID].Version
+}
+
+// approvalTimeout returns how long a request for volumeID may stay pending,
+// preferring the volume's setting over the key's; zero means the server default.
+func (r *ClientRule) approvalTimeout(volumeID string) time.Duration {
+	if t := r.Volumes[volumeID].Timeout; t > 0 {
+		return t
+	}
+	return r.Timeout
 }
 
 type Notifier interface {
 	RequestApproval(reqID, description string) error
+	// Notify sends an informational message that needs no decision.
+	Notify(text string) error
 }
 
 type Handler struct {
 	approvalService *approval.Service
 	vaultClient     vault.Client
 	bot             Notifier
-	clientRules     map[string]*ClientRule
+	rules           atomic.Pointer[ruleSet]
+	legacyPathAuth  bool
+	auditLog        *audit.Logger
+	autoApprove     *policy.Engine
+	limiter         *rateLimiter
+	probes          *probeAlerts
+	metrics         *metrics.Metrics
+}
+
+type Option func(*Handler)
+
+// WithAuditLog records authentication failures, requests and secret fetches.
+func WithAuditLog(l *audit.Logger) Option {
+	return func(h *Handler) {
+		h.auditLog = l
+	}
 }
 
-func New(apiKeys []config.APIKey, approvalSvc *approval.Service, vaultClient vault.Client, bot Notifier) *Handler {
-	rules := make(map[string]*ClientRule)
+// WithAutoApprove approves requests matching the engine's rules without a
+// vote; approvers are still notified.
+func WithAutoApprove(e *policy.Engine) Option {
+	return func(h *Handler) {
+		h.autoApprove = e
+	}
+}
+
+// WithMetrics records secret fetch latency.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(h *Handler) {
+		h.metrics = m
+	}
+}
+
+// WithRateLimit throttles clients per IP and per API key and temporarily
+// bans addresses that keep failing to authenticate.
+func WithRateLimit(cfg config.RateLimitConfig) Option {
+	return func(h *Handler) {
+		h.limiter = newRateLimiter(cfg)
+	}
+}
+
+// WithLegacyPathAuth enables the /unlock/:apiKey/:volumeID routes, which
+// carry the API key in the URL where access logs and shell history see it.
+func WithLegacyPathAuth(enabled bool) Option {
+	return func(h *Handler) {
+		h.legacyPathAuth = enabled
+	}
+}
+
+// ruleSet is the client configuration in effect. Reload replaces it as a
+// whole so in-flight requests keep the rules they authenticated against.
+type ruleSet struct {
+	keyRules     []*ClientRule          // rules that accept an API key
+	keyIDs       map[string]*ClientRule // hashed-key rules by key ID
+	certRules    []*ClientRule          // rules that accept a client certificate
+	verifiedKeys sync.Map               // SHA-256 of a presented key -> *ClientRule, skips slow hash checks
+}
+
+// compileRules builds the rules for apiKeys. Entries with invalid CIDRs are
+// kept without them and reported in the returned errors.
+func compileRules(apiKeys []config.APIKey) (*ruleSet, []error) {
+	rs := &ruleSet{keyIDs: make(map[string]*ClientRule)}
+	var errs []error
 
 	for _, k := range apiKeys {
 		rule := &ClientRule{
+			Name:       ruleName(k),
+			Cert:       certMatchFromConfig(k.ClientCert),
 			PathPrefix: k.PathPrefix,
+			Policy:     policyFromConfig(k.Approval),
+			Timeout:    k.Timeout,
+			Volumes:    k.Volumes,
+		}
+		for _, cidr := range k.AllowedCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid CIDR %s for API key %s: %w", cidr, rule.Name, err))
+				continue
+			}
+			rule.AllowedNets = append(rule.AllowedNets, network)
 		}
-		if len(k.AllowedCIDRs) > 0 {
-			for _, cidr := range k.AllowedCIDRs {
-				_, network, err := net.ParseCIDR(cidr)
-				if err != nil {
-					log.Printf("Warning: Invalid CIDR %s for API key %s: %v", cidr, k.Key, err)
-					continue
-				}
-				rule.AllowedNets = append(rule.AllowedNets, network)
+		switch {
+		case k.KeyHash != "":
+			rule.keyHash = k.KeyHash
+			rule.keyID = k.KeyID
+			rs.keyRules = append(rs.keyRules, rule)
+			if k.KeyID != "" {
+				rs.keyIDs[k.KeyID] = rule
 			}
+		case k.Key != "":
+			sum := sha256.Sum256([]byte(k.Key))
+			rule.keyDigest = sum[:]
+			rs.keyRules = append(rs.keyRules, rule)
 		}
-		rules[k.Key] = rule
+		if rule.Cert != nil {
+			rs.certRules = append(rs.certRules, rule)
+		}
+	}
+	return rs, errs
+}
+
+func New(apiKeys []config.APIKey, approvalSvc *approval.Service, vaultClient vault.Client, bot Notifier, opts ...Option) *Handler {
+	rs, errs := compileRules(apiKeys)
+	for _, err := range errs {
+		log.Printf("Warning: %v", err)
 	}
 
-	return &Handler{
+	h := &Handler{
 		approvalService: approvalSvc,
 		vaultClient:     vaultClient,
 		bot:             bot,
-		clientRules:     rules,
 	}
+	h.rules.Store(rs)
+	for _, opt := range opts {
+		opt(h)
+	}
+	window := defaultBanDuration
+	if h.limiter != nil {
+		window = h.limiter.banDuration
+	}
+	h.probes = newProbeAlerts(window)
+	return h
 }
 
-func (h *Handler) RegisterRoutes(r *gin.Engine) {
-	// Route: /unlock/:apiKey/:volumeID
-	r.GET("/unlock/:apiKey/:volumeID", h.authMiddleware, h.handleUnlock)
-	r.POST("/unlock/:apiKey/:volumeID", h.authMiddleware, h.handleUnlock)
+// Rules is a compiled API key configuration, ready to be swapped into a Handler.
+type Rules struct {
+	rs *ruleSet
 }
 
-func (h *Handler) authMiddleware(c *gin.Context) {
-	apiKey := c.Param("apiKey")
-	if apiKey == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing key parameter"})
-		return
-	}
-
-	rule, exists := h.clientRules[apiKey]
-	if !exists {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+// CompileRules checks and compiles apiKeys without putting them in effect.
+// Unlike New it rejects invalid entries.
+func CompileRules(apiKeys []config.APIKey) (*Rules, error) {
+	rs, errs := compileRules(apiKeys)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
+	return &Rules{rs: rs}, nil
+}
 
-	// Check IP restrictions
-	if len(rule.AllowedNets) > 0 {
-		clientIPStr := c.ClientIP()
-		clientIP := net.ParseIP(clientIPStr)
-
-		if clientIP == nil {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid IP"})
-			return
-		}
+// SwapRules puts compiled API key rules in effect. In-flight requests keep
+// the rules they authenticated against.
+func (h *Handler) SwapRules(rules *Rules) {
+	h.rules.Store(rules.rs)
+}
 
-		allowed := false
-		for _, network := range rule.AllowedNets {
-			if network.Contains(clientIP) {
-				allowed = true
-				break
-			}
-		}
+func policyFromConfig(p config.ApprovalPolicy) approval.Policy {
+	return approval.Policy{
+		RequiredApprovals: max(p.RequiredApprovals, 1),
+		Approvers:         p.Approvers,
+		DenyVeto:          p.DenyVeto == nil || *p.DenyVeto,
+	}
+}
 
-		if !allowed {
-			log.Printf("Access denied for key %s from IP %s", apiKey, clientIPStr)
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "IP not allowed"})
-			return
-		}
+func (h *Handler) RegisterRoutes(r *gin.Engine) {
+	// Legacy route: /unlock/:apiKey/:volumeID (opt-in)
+	if h.legacyPathAuth {
+		r.GET("/unlock/:apiKey/:volumeID", h.rateLimitMiddleware, h.authMiddleware, h.handleUnlock)
+		r.POST("/unlock/:apiKey/:volumeID", h.rateLimitMiddleware, h.authMiddleware, h.handleUnlock)
 	}
 
-	// Store rule info in context for the handler
-	c.Set("clientRule", rule)
-	c.Next()
+	// Authenticated by Authorization header or client certificate.
+	v1 := r.Group("/v1", h.rateLimitMiddleware, h.authMiddleware)
+	v1.GET("/unlock/:volumeID", h.handleUnlock)
+	v1.POST("/unlock/:volumeID", h.handleUnlock)
+	v1.POST("/unlock", h.handleBatchUnlock)
+
+	// Two-phase API: create a request, then poll it until it is decided.
+	v1.POST("/requests", h.handleCreateRequest)
+	v1.GET("/requests/:id", h.handleGetRequest)
 }
 
 func (h *Handler) handleUnlock(c *gin.Context) {
@@ -117,54 +244,211 @@ func (h *Handler) handleUnlock(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing volume ID"})
 		return
 	}
+	if !validVolumeIDs([]string{volumeID}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid volume ID"})
+		return
+	}
 
-	// 1. Create request
-	reqID, waitChan := h.approvalService.NewRequest()
+	var version int
+	if v := c.Query("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+			return
+		}
+		version = n
+	}
 
-	// 2. Notify via Telegram
-	msg := fmt.Sprintf("Request to unlock volume: `%s`", volumeID)
-	err := h.bot.RequestApproval(reqID, msg)
+	// 1. Create request and notify via Telegram
+	reqID, waitChan, err := h.startRequest(c, rule, volumeID, version, false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send approval request"})
-		h.approvalService.ResolveRequest(reqID, false) // cleanup
 		return
 	}
 
-	// 3. Wait for decision
+	// 2. Wait for decision. The approval service expires the request at its deadline.
+	approved, ok := h.awaitDecision(c, reqID, waitChan)
+	if !ok {
+		return
+	}
+	req, _ := h.approvalService.Get(reqID)
+	if !approved {
+		switch req.Status {
+		case approval.StatusExpired:
+			c.JSON(http.StatusGatewayTimeout, gin.H{"status": "timeout"})
+			return
+		case approval.StatusCancelled, approval.StatusPending: // still pending: suspended for a restart
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "cancelled"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{"status": "denied"})
+		return
+	}
+
+	// 3. Retrieve secret from Vault
+	secret, err := h.fetchSecret(c.Request.Context(), rule, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Approved, but failed to fetch secret"})
+		return
+	}
+
+	decoded, found, err := decodeKey(secret, rule.keyFormat(volumeID, secret))
+	if err != nil {
+		log.Printf("Failed to decode key for %s: %v", volumeID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode key"})
+		return
+	}
+	if found {
+		c.Data(http.StatusOK, "application/octet-stream", decoded)
+		return
+	}
+
+	// Fallback: If we can't find a single key, return JSON (useful for debugging)
+	c.JSON(http.StatusOK, gin.H{"status": "approved", "secret": secret})
+}
+
+// validVolumeIDs reports whether every ID is a single secret path segment.
+// Volume IDs from request bodies could otherwise climb out of the key prefix.
+func validVolumeIDs(ids []string) bool {
+	for _, id := range ids {
+		if !vault.ValidSegment(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitDecision waits for the outcome of a request. If the client goes away
+// first, its wait is withdrawn and ok is false; there is nobody to answer.
+func (h *Handler) awaitDecision(c *gin.Context, reqID string, waitChan <-chan bool) (approved, ok bool) {
 	select {
-	case approved := <-waitChan:
-		if approved {
-			// Retrieve secret from Vault
-			// Uses stored PathPrefix from config and extracted VolumeID
-			secret, err := h.vaultClient.GetSecret(c.Request.Context(), rule.PathPrefix, volumeID)
-			if err != nil {
-				log.Printf("Vault fetch failed: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Approved, but failed to fetch secret"})
-				return
-			}
+	case approved = <-waitChan:
+		return approved, true
+	case <-c.Request.Context().Done():
+		h.approvalService.Abandon(reqID, waitChan)
+		log.Printf("Client of request %s disconnected before a decision", reqID)
+		return false, false
+	}
+}
 
-			// ZFS Compatibility: The key in Vault is always Base64 encoded.
-			// We decode it and return the raw bytes.
-			if val, ok := secret["key"]; ok {
-				strVal := fmt.Sprintf("%v", val)
-
-				decoded, err := base64.StdEncoding.DecodeString(strVal)
-				if err != nil {
-					log.Printf("Failed to decode base64 key for %s: %v", c.Param("apiKey"), err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode key"})
-					return
-				}
-				c.Data(http.StatusOK, "application/octet-stream", decoded)
-				return
-			}
+// startRequest creates an approval request for volumeID and sends it to the
+// approvers. Two-phase requests hand out their key only once, so they are
+// never joined by blocking requests or the other way round.
+func (h *Handler) startRequest(c *gin.Context, rule *ClientRule, volumeID string, version int, twoPhase bool) (string, <-chan bool, error) {
+	return h.submit(approval.Request{
+		TwoPhase:    twoPhase,
+		VolumeID:    volumeID,
+		Version:     rule.secretVersion(volumeID, version),
+		APIKey:      c.GetString("keyName"),
+		ClientIP:    c.ClientIP(),
+		Description: fmt.Sprintf("Request to unlock volume: `%s`", volumeID),
+		Policy:      rule.Policy,
+		Timeout:     rule.approvalTimeout(volumeID),
+	})
+}
+
+// submit creates the approval request described by info, or joins an
+// identical pending one. New requests covered by a grant or an auto-approve
+// rule are approved right away and approvers are only notified; all others
+// are sent to the approvers for a vote.
+func (h *Handler) submit(info approval.Request) (string, <-chan bool, error) {
+	volumeID := info.VolumeID
+	// Retries of a pending request wait on it instead of messaging approvers again.
+	reqID, waitChan, joined := h.approvalService.Coalesce(info)
+	ev := audit.Event{
+		Type:      audit.EventRequestCreated,
+		RequestID: reqID,
+		APIKey:    info.APIKey,
+		VolumeID:  volumeID,
+		ClientIP:  info.ClientIP,
+	}
+	if joined {
+		ev.Type = audit.EventRequestJoined
+	}
+	h.auditLog.Record(ev)
+	if joined {
+		return reqID, waitChan, nil
+	}
+
+	// Approvers still hear about requests that need no vote, but a failed
+	// notice does not block the unlock.
+	if req, _ := h.approvalService.Get(reqID); req.Grant != "" {
+		h.notify(reqID, fmt.Sprintf("🗓 Pre-approved unlock of %s for %s (%s) by grant %s from %s", volumeID, info.APIKey, info.ClientIP, req.Grant, req.DeciderNames()))
+		return reqID, waitChan, nil
+	}
 
-			// Fallback: If we can't find a single key, return JSON (useful for debugging)
-			c.JSON(http.StatusOK, gin.H{"status": "approved", "secret": secret})
+	// Like grants, a policy stands in for a single approval, so keys that
+	// need a quorum or restrict who may approve always go to a vote.
+	var ruleName string
+	var autoApproved bool
+	if p := info.Policy; p.RequiredApprovals <= 1 && len(p.Approvers) == 0 {
+		ruleName, autoApproved = h.autoApprove.Evaluate(policy.Request{
+			APIKey:   info.APIKey,
+			VolumeID: volumeID,
+			Volumes:  info.Volumes,
+			ClientIP: info.ClientIP,
+		})
+	}
+	if autoApproved {
+		h.auditLog.Record(audit.Event{
+			Type:      audit.EventAutoApproved,
+			RequestID: reqID,
+			APIKey:    info.APIKey,
+			VolumeID:  volumeID,
+			ClientIP:  info.ClientIP,
+			Actor:     "policy:" + ruleName,
+		})
+		h.approvalService.ResolveRequest(reqID, true)
+		log.Printf("Request %s auto-approved by policy %s", reqID, ruleName)
+		h.notify(reqID, fmt.Sprintf("🤖 Auto-approved unlock of %s for %s (%s) by policy %s", volumeID, info.APIKey, info.ClientIP, ruleName))
+		return reqID, waitChan, nil
+	}
+
+	if err := h.bot.RequestApproval(reqID, info.Description); err != nil {
+		log.Printf("Failed to send approval request %s: %v", reqID, err)
+		// Clients that joined meanwhile get a 503 rather than a denial.
+		h.approvalService.Cancel(reqID)
+		return "", nil, err
+	}
+	return reqID, waitChan, nil
+}
+
+// notify sends an informational notice about a request, logging failures.
+func (h *Handler) notify(reqID, text string) {
+	if err := h.bot.Notify(text); err != nil {
+		log.Printf("Failed to send notice for %s: %v", reqID, err)
+	}
+}
+
+// fetchSecret retrieves the secret of an approved request and records the outcome.
+// Uses stored PathPrefix from config and the request's VolumeID.
+func (h *Handler) fetchSecret(ctx context.Context, rule *ClientRule, req approval.Request) (map[string]interface{}, error) {
+	var secret map[string]interface{}
+	var err error
+	start := time.Now()
+	if req.Version > 0 {
+		if versioned, ok := h.vaultClient.(vault.VersionedClient); ok {
+			secret, err = versioned.GetSecretVersion(ctx, rule.PathPrefix, req.VolumeID, req.Version)
 		} else {
-			c.JSON(http.StatusForbidden, gin.H{"status": "denied"})
+			err = errors.New("secret backend does not support versions")
 		}
-	case <-time.After(5 * time.Minute): // Timeout
-		h.approvalService.ResolveRequest(reqID, false)
-		c.JSON(http.StatusGatewayTimeout, gin.H{"status": "timeout"})
+	} else {
+		secret, err = h.vaultClient.GetSecret(ctx, rule.PathPrefix, req.VolumeID)
+	}
+	h.metrics.SecretFetched(time.Since(start), err)
+
+	ev := audit.Event{
+		Type:      audit.EventSecretFetched,
+		RequestID: req.ID,
+		APIKey:    req.APIKey,
+		VolumeID:  req.VolumeID,
+		ClientIP:  req.ClientIP,
+	}
+	if err != nil {
+		log.Printf("Vault fetch failed: %v", err)
+		ev.Type = audit.EventSecretFetchFail
+		ev.Detail = err.Error()
 	}
+	h.auditLog.Record(ev)
+	return secret, err
 }
@@ -2,13 +2,28 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"zfs-unlocker/internal/apikey"
 	"zfs-unlocker/internal/approval"
+	"zfs-unlocker/internal/audit"
 	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/policy"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,11 +31,31 @@ import (
 // --- Mocks ---
 
 type MockNotifier struct {
+	mu            sync.Mutex
 	CapturedReqID string
+	Prompts       int
+	Notices       []string
 }
 
 func (m *MockNotifier) RequestApproval(reqID, description string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.CapturedReqID = reqID
+	m.Prompts++
+	return nil
+}
+
+// ReqID returns the ID of the last request sent for approval.
+func (m *MockNotifier) ReqID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.CapturedReqID
+}
+
+func (m *MockNotifier) Notify(text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Notices = append(m.Notices, text)
 	return nil
 }
 
@@ -36,6 +71,16 @@ func (m *MockVault) GetSecret(ctx context.Context, keyPrefix, volumeID string) (
 	return m.SecretToReturn, nil
 }
 
+type MockVersionedVault struct {
+	MockVault
+	RequestedVersion int
+}
+
+func (m *MockVersionedVault) GetSecretVersion(ctx context.Context, keyPrefix, volumeID string, version int) (map[string]interface{}, error) {
+	m.RequestedVersion = version
+	return m.GetSecret(ctx, keyPrefix, volumeID)
+}
+
 // --- Tests ---
 
 func TestHandler_Auth_MissingKey(t *testing.T) {
@@ -47,7 +92,7 @@ func TestHandler_Auth_MissingKey(t *testing.T) {
 	mockVault := &MockVault{}
 
 	// Empty config
-	handler := New([]config.APIKey{}, approvalSvc, mockVault, mockBot)
+	handler := New([]config.APIKey{}, approvalSvc, mockVault, mockBot, WithLegacyPathAuth(true))
 
 	r := gin.New()
 	handler.RegisterRoutes(r)
@@ -76,7 +121,7 @@ func TestHandler_Unlock_Success(t *testing.T) {
 		{Key: "test-key", PathPrefix: "server-1"},
 	}
 
-	handler := New(keys, approvalSvc, mockVault, mockBot)
+	handler := New(keys, approvalSvc, mockVault, mockBot, WithLegacyPathAuth(true))
 
 	r := gin.New()
 	handler.RegisterRoutes(r)
@@ -97,12 +142,12 @@ func TestHandler_Unlock_Success(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 
 	// Check if bot got a request ID
-	if mockBot.CapturedReqID == "" {
+	if mockBot.ReqID() == "" {
 		t.Fatal("Bot was not called with a request ID")
 	}
 
 	// Approve the request
-	success := approvalSvc.ResolveRequest(mockBot.CapturedReqID, true)
+	success := approvalSvc.ResolveRequest(mockBot.ReqID(), true)
 	if !success {
 		t.Fatal("Failed to resolve request (maybe ID mismatch?)")
 	}
@@ -132,7 +177,7 @@ func TestHandler_Unlock_Deny(t *testing.T) {
 	mockVault := &MockVault{}
 
 	keys := []config.APIKey{{Key: "test-key"}}
-	handler := New(keys, approvalSvc, mockVault, mockBot)
+	handler := New(keys, approvalSvc, mockVault, mockBot, WithLegacyPathAuth(true))
 
 	r := gin.New()
 	handler.RegisterRoutes(r)
@@ -148,12 +193,12 @@ func TestHandler_Unlock_Deny(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	if mockBot.CapturedReqID == "" {
+	if mockBot.ReqID() == "" {
 		t.Fatal("Bot was not called")
 	}
 
 	// Deny the request
-	approvalSvc.ResolveRequest(mockBot.CapturedReqID, false)
+	approvalSvc.ResolveRequest(mockBot.ReqID(), false)
 
 	<-done
 
@@ -171,7 +216,7 @@ func TestHandler_Unlock_AlwaysRaw(t *testing.T) {
 		SecretToReturn: map[string]interface{}{"key": "aGVsbG8="},
 	}
 	keys := []config.APIKey{{Key: "test-key"}}
-	handler := New(keys, approvalSvc, mockVault, mockBot)
+	handler := New(keys, approvalSvc, mockVault, mockBot, WithLegacyPathAuth(true))
 
 	r := gin.New()
 	handler.RegisterRoutes(r)
@@ -186,7 +231,7 @@ func TestHandler_Unlock_AlwaysRaw(t *testing.T) {
 	}()
 
 	time.Sleep(50 * time.Millisecond)
-	approvalSvc.ResolveRequest(mockBot.CapturedReqID, true)
+	approvalSvc.ResolveRequest(mockBot.ReqID(), true)
 	<-done
 
 	if w.Code != http.StatusOK {
@@ -196,3 +241,955 @@ func TestHandler_Unlock_AlwaysRaw(t *testing.T) {
 		t.Errorf("Expected decoded body 'hello', got '%s'", w.Body.String())
 	}
 }
+
+func TestHandler_Requests_TwoPhase(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	mockBot := &MockNotifier{}
+	mockVault := &MockVault{
+		SecretToReturn: map[string]interface{}{"key": "aGVsbG8="},
+	}
+	keys := []config.APIKey{{Key: "test-key"}, {Key: "other-key"}}
+	handler := New(keys, approvalSvc, mockVault, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	// 1. Create the request; it must return immediately.
+	req, _ := http.NewRequest("POST", "/v1/requests", strings.NewReader(`{"volume_id": "vol-data"}`))
+	req.Header.Set("Authorization", "Bearer test-key")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 Accepted, got %d. Body: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.ID == "" || created.ID != mockBot.ReqID() || created.Status != "pending" {
+		t.Fatalf("Unexpected create response: %s", w.Body.String())
+	}
+
+	// 2. Another API key must not see the request.
+	req, _ = http.NewRequest("GET", "/v1/requests/"+created.ID, nil)
+	req.Header.Set("Authorization", "Bearer other-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for foreign API key, got %d", w.Code)
+	}
+
+	// 3. Long-poll while the request gets approved.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		approvalSvc.ResolveRequest(created.ID, true)
+	}()
+
+	req, _ = http.NewRequest("GET", "/v1/requests/"+created.ID+"?wait=5s", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", w.Code)
+	}
+	var polled struct {
+		Status string `json:"status"`
+		Key    []byte `json:"key"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &polled)
+	if polled.Status != "approved" || string(polled.Key) != "hello" {
+		t.Errorf("Expected approved status with key 'hello', got %s", w.Body.String())
+	}
+
+	// 4. The key is delivered only once.
+	req, _ = http.NewRequest("GET", "/v1/requests/"+created.ID, nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	polled.Key = nil
+	json.Unmarshal(w.Body.Bytes(), &polled)
+	if w.Code != http.StatusGone || polled.Status != "approved" || polled.Key != nil {
+		t.Errorf("Expected 410 Gone without a key on the second fetch, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_Requests_InvalidVolumeID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockBot := &MockNotifier{}
+	handler := New([]config.APIKey{{Key: "test-key"}}, approval.New(), &MockVault{}, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	req, _ := http.NewRequest("POST", "/v1/requests", strings.NewReader(`{"volume_id": "../other/key"}`))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest || mockBot.ReqID() != "" {
+		t.Errorf("Expected 400 without an approval prompt, got %d", w.Code)
+	}
+}
+
+func TestHandler_Requests_Batch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	handler := New(keys, approvalSvc, &MockVault{SecretToReturn: map[string]interface{}{"key": "c2VjcmV0"}}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	req, _ := http.NewRequest("POST", "/v1/requests", strings.NewReader(`{"volumes": ["vol-b", "vol-a", "vol-a"]}`))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp requestResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusAccepted || resp.VolumeID != "vol-a,vol-b" {
+		t.Fatalf("Expected a batch request for vol-a and vol-b, got %d %s", w.Code, w.Body.String())
+	}
+	approvalSvc.ToggleVolume(resp.ID, 1, approval.Voter{ID: 1})
+	approvalSvc.ResolveRequest(resp.ID, true)
+
+	req, _ = http.NewRequest("GET", "/v1/requests/"+resp.ID, nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	resp = requestResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Keys) != 1 || string(resp.Keys["vol-a"]) != "secret" || resp.Key != nil {
+		t.Errorf("Expected the key of vol-a only, got %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.Excluded) != 1 || resp.Excluded[0] != "vol-b" {
+		t.Errorf("Expected vol-b to be excluded, got %v", resp.Excluded)
+	}
+}
+
+func TestHandler_Requests_InvalidWait(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := New([]config.APIKey{{Key: "test-key"}}, approval.New(), &MockVault{}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	req, _ := http.NewRequest("GET", "/v1/requests/some-id?wait=forever", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request, got %d", w.Code)
+	}
+}
+
+func TestHandler_Unlock_Version(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		url      string
+		expected int
+	}{
+		{"pinned in config", "/unlock/test-key/vol-pinned", 3},
+		{"query overrides pin", "/unlock/test-key/vol-pinned?version=5", 5},
+		{"latest by default", "/unlock/test-key/vol-other", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			approvalSvc := approval.New()
+			mockBot := &MockNotifier{}
+			mockVault := &MockVersionedVault{
+				MockVault: MockVault{SecretToReturn: map[string]interface{}{"key": "aGVsbG8="}},
+			}
+			keys := []config.APIKey{{
+				Key:     "test-key",
+				Volumes: map[string]config.VolumeConfig{"vol-pinned": {Version: 3}},
+			}}
+			handler := New(keys, approvalSvc, mockVault, mockBot, WithLegacyPathAuth(true))
+
+			r := gin.New()
+			handler.RegisterRoutes(r)
+			done := make(chan bool)
+			w := httptest.NewRecorder()
+
+			go func() {
+				req, _ := http.NewRequest("GET", tt.url, nil)
+				r.ServeHTTP(w, req)
+				close(done)
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			approvalSvc.ResolveRequest(mockBot.ReqID(), true)
+			<-done
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200 OK, got %d", w.Code)
+			}
+			if mockVault.RequestedVersion != tt.expected {
+				t.Errorf("Expected version %d, got %d", tt.expected, mockVault.RequestedVersion)
+			}
+		})
+	}
+}
+
+func TestHandler_Unlock_KeyNeverRecorded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	store := approval.NewMemoryStore()
+	approvalSvc := approval.New(approval.WithStore(store))
+	mockBot := &MockNotifier{}
+	keys := []config.APIKey{{Key: "legacy-secret-key"}}
+	handler := New(keys, approvalSvc, &MockVault{SecretToReturn: map[string]interface{}{"key": "aGVsbG8="}}, mockBot,
+		WithLegacyPathAuth(true), WithAuditLog(auditLog))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		approvalSvc.ResolveRequest(mockBot.ReqID(), true)
+	}()
+	req, _ := http.NewRequest("GET", "/unlock/legacy-secret-key/vol-data", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", w.Code)
+	}
+
+	stored, _, _ := store.Get(mockBot.ReqID())
+	if stored.APIKey != ruleName(keys[0]) {
+		t.Errorf("Expected the stored request to name the key %q, got %q", ruleName(keys[0]), stored.APIKey)
+	}
+	data, _ := os.ReadFile(auditPath)
+	if len(data) == 0 || strings.Contains(string(data), "legacy-secret-key") {
+		t.Errorf("Expected audit events without the API key, got %s", data)
+	}
+}
+
+func TestHandler_LegacyPathDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := New([]config.APIKey{{Key: "test-key"}}, approval.New(), &MockVault{}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	req, _ := http.NewRequest("GET", "/unlock/test-key/vol-data", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for legacy route without opt-in, got %d", w.Code)
+	}
+}
+
+func TestHandler_Unlock_BearerAndClientCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "nas-01"},
+		DNSNames: []string{"nas-01.example.com"},
+	}
+	keys := []config.APIKey{
+		{Name: "server-01", Key: "test-key"},
+		{Name: "nas-01", ClientCert: config.ClientCertMatch{Subject: "nas-01", DNSName: "nas-01.example.com"}},
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(req *http.Request)
+		expected string
+	}{
+		{"bearer header", func(req *http.Request) { req.Header.Set("Authorization", "Bearer test-key") }, "server-01"},
+		{"client certificate", func(req *http.Request) {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}, "nas-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			approvalSvc := approval.New()
+			mockBot := &MockNotifier{}
+			mockVault := &MockVault{SecretToReturn: map[string]interface{}{"key": "aGVsbG8="}}
+			handler := New(keys, approvalSvc, mockVault, mockBot)
+
+			r := gin.New()
+			handler.RegisterRoutes(r)
+			done := make(chan bool)
+			w := httptest.NewRecorder()
+
+			go func() {
+				req, _ := http.NewRequest("GET", "/v1/unlock/vol-data", nil)
+				tt.setup(req)
+				r.ServeHTTP(w, req)
+				close(done)
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			if mockBot.ReqID() == "" {
+				t.Fatal("Bot was not called")
+			}
+			if req, _ := approvalSvc.Get(mockBot.ReqID()); req.APIKey != tt.expected {
+				t.Errorf("Expected request attributed to %q, got %q", tt.expected, req.APIKey)
+			}
+			approvalSvc.ResolveRequest(mockBot.ReqID(), true)
+			<-done
+
+			if w.Code != http.StatusOK || w.Body.String() != "hello" {
+				t.Errorf("Expected 200 OK with key, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_Auth_UnverifiedCertRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := []config.APIKey{{Name: "nas-01", ClientCert: config.ClientCertMatch{Subject: "nas-01"}}}
+	handler := New(keys, approval.New(), &MockVault{}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "nas-01"}}
+	req, _ := http.NewRequest("GET", "/v1/unlock/vol-data", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for unverified certificate, got %d", w.Code)
+	}
+}
+
+func TestLogFormatter_RedactsLegacyKey(t *testing.T) {
+	line := LogFormatter(gin.LogFormatterParams{Path: "/unlock/secret-key/vol-data", Method: "GET", TimeStamp: time.Now()})
+	if strings.Contains(line, "secret-key") || !strings.Contains(line, "/unlock/REDACTED/vol-data") {
+		t.Errorf("Expected API key to be redacted, got %q", line)
+	}
+}
+
+func TestHandler_Auth_HashedKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hash, err := apikey.Hash(apikey.Argon2id, "abcd.hashed-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Slow hashes without a key ID are never checked, not even for their key.
+	legacy, err := apikey.Hash(apikey.Argon2id, "legacy-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []config.APIKey{{Name: "hashed", KeyID: "abcd", KeyHash: hash}, {Name: "legacy", KeyHash: legacy}}
+	handler := New(keys, approval.New(), &MockVault{}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	for _, tt := range []struct {
+		key      string
+		expected int
+	}{
+		{"wrong-key", http.StatusUnauthorized},
+		{"legacy-key", http.StatusUnauthorized},
+		{"abcd.hashed-key", http.StatusNotFound}, // authenticated; the request itself is unknown
+		{"abcd.hashed-key", http.StatusNotFound}, // served from the verification cache
+	} {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != tt.expected {
+			t.Errorf("Key %q: expected %d, got %d", tt.key, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestHandler_Auth_KeyID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hashA, _ := apikey.Hash(apikey.SHA256, "aaaa.secret")
+	// Entry b carries the hash of a key presented with a's ID; it must never be checked.
+	hashB, _ := apikey.Hash(apikey.SHA256, "aaaa.other")
+	hashLegacy, _ := apikey.Hash(apikey.SHA256, "legacy-key")
+	keys := []config.APIKey{
+		{Name: "a", KeyID: "aaaa", KeyHash: hashA},
+		{Name: "b", KeyID: "bbbb", KeyHash: hashB},
+		{Name: "legacy", KeyHash: hashLegacy},
+	}
+	handler := New(keys, approval.New(), &MockVault{}, &MockNotifier{})
+
+	for _, tt := range []struct {
+		key  string
+		want string
+	}{
+		{"aaaa.secret", "a"},
+		{"aaaa.other", ""},
+		{"legacy-key", "legacy"},
+		{"cccc.secret", ""},
+	} {
+		got := ""
+		if rule := handler.ruleForKey(tt.key); rule != nil {
+			got = rule.Name
+		}
+		if got != tt.want {
+			t.Errorf("Key %q: expected rule %q, got %q", tt.key, tt.want, got)
+		}
+	}
+}
+
+func TestHandler_CompileAndSwapRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := New([]config.APIKey{{Name: "old", Key: "old-key"}}, approval.New(), &MockVault{}, &MockNotifier{})
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	status := func(key string) int {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	rules, err := CompileRules([]config.APIKey{{Name: "new", Key: "new-key"}})
+	if err != nil {
+		t.Fatalf("CompileRules failed: %v", err)
+	}
+	// Compiling alone changes nothing.
+	if status("old-key") != http.StatusNotFound || status("new-key") != http.StatusUnauthorized {
+		t.Errorf("Expected the old key to stay in effect until the rules are swapped")
+	}
+	handler.SwapRules(rules)
+	if status("old-key") != http.StatusUnauthorized || status("new-key") != http.StatusNotFound {
+		t.Errorf("Expected only the new key to authenticate after a reload")
+	}
+
+	// An invalid configuration is rejected and the current keys stay in effect.
+	bad := []config.APIKey{{Name: "bad", Key: "bad-key", AllowedCIDRs: []string{"not-a-cidr"}}}
+	if _, err := CompileRules(bad); err == nil {
+		t.Fatal("Expected CompileRules to reject an invalid CIDR")
+	}
+	if status("bad-key") != http.StatusUnauthorized || status("new-key") != http.StatusNotFound {
+		t.Errorf("Expected the previous keys to remain after a rejected reload")
+	}
+}
+
+func TestHandler_Unlock_AutoApprove(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine, err := policy.New([]config.AutoApproveRule{
+		{Name: "scratch", Volumes: []string{"scratch-*"}, Max: 1, Per: 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockVault := &MockVault{SecretToReturn: map[string]interface{}{"key": "c2VjcmV0"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approval.New(), mockVault, mockBot, WithAutoApprove(engine))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	req, _ := http.NewRequest("GET", "/v1/unlock/scratch-01", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Fatalf("Expected auto-approved key, got %d: %s", w.Code, w.Body.String())
+	}
+	if mockBot.ReqID() != "" {
+		t.Error("Expected no approval prompt for an auto-approved request")
+	}
+	if len(mockBot.Notices) != 1 || !strings.Contains(mockBot.Notices[0], "policy scratch") {
+		t.Errorf("Expected an auto-approval notice, got %v", mockBot.Notices)
+	}
+
+	// The rate limit is used up, so the next request goes to the approvers.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		handler.approvalService.ResolveRequest(mockBot.ReqID(), false)
+	}()
+	req, _ = http.NewRequest("GET", "/v1/unlock/scratch-01", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden || mockBot.ReqID() == "" {
+		t.Errorf("Expected a manual decision once the rate limit is reached, got %d", w.Code)
+	}
+}
+
+func TestHandler_Unlock_AutoApproveSkipsQuorum(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine, err := policy.New([]config.AutoApproveRule{{Name: "everything"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []config.APIKey{
+		{Name: "quorum", Key: "quorum-key", Approval: config.ApprovalPolicy{RequiredApprovals: 2}},
+		{Name: "restricted", Key: "restricted-key", Approval: config.ApprovalPolicy{Approvers: []int64{1}}},
+	}
+	mockVault := &MockVault{SecretToReturn: map[string]interface{}{"key": "c2VjcmV0"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approval.New(), mockVault, mockBot, WithAutoApprove(engine))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	for i, key := range []string{"quorum-key", "restricted-key"} {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			handler.approvalService.ResolveRequest(mockBot.ReqID(), false)
+		}()
+		req, _ := http.NewRequest("GET", "/v1/unlock/vol-1", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden || mockBot.Prompts != i+1 {
+			t.Errorf("Key %q: expected the request to go to a vote, got %d", key, w.Code)
+		}
+	}
+	if len(mockBot.Notices) != 0 {
+		t.Errorf("Expected no auto-approval notices, got %v", mockBot.Notices)
+	}
+}
+
+func TestHandler_Unlock_Suspended(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approvalSvc, &MockVault{}, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	// A shutdown with persistent storage leaves the request pending.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		approvalSvc.Suspend()
+	}()
+	req, _ := http.NewRequest("GET", "/v1/unlock/vol-1", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "cancelled") {
+		t.Errorf("Expected 503 cancelled for a suspended request, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_BatchUnlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockVault := &MockVault{SecretToReturn: map[string]interface{}{"key": "c2VjcmV0"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approvalSvc, mockVault, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	// The approver leaves vol-b out and approves the rest.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		alice := approval.Voter{ID: 1, Name: "alice"}
+		if _, err := approvalSvc.ToggleVolume(mockBot.ReqID(), 1, alice); err != nil {
+			t.Errorf("ToggleVolume failed: %v", err)
+		}
+		approvalSvc.Vote(mockBot.ReqID(), alice, true)
+	}()
+
+	body := strings.NewReader(`{"volumes": ["vol-c", "vol-a", "vol-b", "vol-a"]}`)
+	req, _ := http.NewRequest("POST", "/v1/unlock", body)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp batchUnlockResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Keys) != 2 || string(resp.Keys["vol-a"]) != "secret" || string(resp.Keys["vol-c"]) != "secret" {
+		t.Errorf("Expected keys for vol-a and vol-c, got %v", resp.Keys)
+	}
+	if len(resp.Excluded) != 1 || resp.Excluded[0] != "vol-b" {
+		t.Errorf("Expected vol-b to be excluded, got %v", resp.Excluded)
+	}
+}
+
+func TestHandler_BatchUnlock_InvalidVolumeID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approval.New(), &MockVault{}, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	for _, volumes := range []string{`["vol-a", "../other/key"]`, `["."]`, `["..", "vol-a"]`, `["a/b"]`} {
+		req, _ := http.NewRequest("POST", "/v1/unlock", strings.NewReader(`{"volumes": `+volumes+`}`))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Volumes %s: expected 400, got %d", volumes, w.Code)
+		}
+	}
+	if mockBot.ReqID() != "" {
+		t.Error("Expected no approval prompt for invalid volume IDs")
+	}
+}
+
+func TestHandler_Unlock_ClientDisconnects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	mockBot := &MockNotifier{}
+	handler := New([]config.APIKey{{Key: "test-key"}}, approvalSvc, &MockVault{}, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/v1/unlock/vol-data", nil)
+	req.Header.Set("Authorization", "Bearer test-key")
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to return once the client disconnected")
+	}
+
+	if got, _ := approvalSvc.Get(mockBot.ReqID()); got.Status != approval.StatusAbandoned {
+		t.Errorf("Expected the request to be abandoned, got %s", got.Status)
+	}
+}
+
+func TestHandler_Unlock_CoalescesRetries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockVault := &MockVault{SecretToReturn: map[string]interface{}{"key": "c2VjcmV0"}}
+	mockBot := &MockNotifier{}
+	handler := New(keys, approvalSvc, mockVault, mockBot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/v1/unlock/vol-data", nil)
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mockBot.mu.Lock()
+	prompts, reqID := mockBot.Prompts, mockBot.CapturedReqID
+	mockBot.mu.Unlock()
+	approvalSvc.ResolveRequest(reqID, true)
+	wg.Wait()
+
+	if prompts != 1 {
+		t.Errorf("Expected one approval prompt for concurrent retries, got %d", prompts)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Waiter %d: expected 200, got %d", i+1, code)
+		}
+	}
+}
+
+// failingNotifier fails every approval prompt once release is closed.
+type failingNotifier struct {
+	release chan struct{}
+}
+
+func (f *failingNotifier) RequestApproval(reqID, description string) error {
+	<-f.release
+	return errors.New("telegram unreachable")
+}
+
+func (f *failingNotifier) Notify(text string) error { return nil }
+
+func TestHandler_Unlock_PromptFailureIsNotADenial(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	approvalSvc := approval.New()
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	bot := &failingNotifier{release: make(chan struct{})}
+	handler := New(keys, approvalSvc, &MockVault{}, bot)
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	// The second client joins the request while its prompt is being sent.
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/v1/unlock/vol-data", nil)
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(bot.release)
+	wg.Wait()
+
+	slices.Sort(codes)
+	if !slices.Equal(codes, []int{http.StatusInternalServerError, http.StatusServiceUnavailable}) {
+		t.Errorf("Expected 500 for the creator and 503 for the joined client, got %v", codes)
+	}
+	if pending := approvalSvc.Pending(); len(pending) != 0 {
+		t.Errorf("Expected the failed request to be removed, got %d pending", len(pending))
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key"}}
+	mockBot := &MockNotifier{}
+	limits := config.RateLimitConfig{PerIPBurst: 100, PerKeyBurst: 2, MaxFailures: 3, BanDuration: time.Minute}
+	handler := New(keys, approval.New(), &MockVault{}, mockBot, WithRateLimit(limits))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+
+	status := func(key, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The per-key bucket holds two requests.
+	for i := range 2 {
+		if w := status("test-key", "192.0.2.1"); w.Code != http.StatusNotFound {
+			t.Fatalf("Request %d: expected 404, got %d", i+1, w.Code)
+		}
+	}
+	if w := status("test-key", "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the key's burst is used up, got %d", w.Code)
+	}
+
+	// The third failure bans the address, even for a valid key.
+	for i := range 3 {
+		if w := status("guess", "198.51.100.7"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Guess %d: expected 401, got %d", i+1, w.Code)
+		}
+	}
+	w := status("test-key", "198.51.100.7")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected a banned address to get 429 with Retry-After 60, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mockBot.mu.Lock()
+	defer mockBot.mu.Unlock()
+	notices := strings.Join(mockBot.Notices, "\n")
+	if len(mockBot.Notices) != 2 || !strings.Contains(notices, "Rejected request from 198.51.100.7") || !strings.Contains(notices, "Banned 198.51.100.7") {
+		t.Errorf("Expected a probe alert and a ban alert, got %q", mockBot.Notices)
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	hexKey := strings.Repeat("0f", 32)
+	tests := []struct {
+		name, format, key, want string
+		wantErr                 bool
+	}{
+		{"undeclared passes through", "", "hello", "hello", false},
+		{"raw", "raw", strings.Repeat("k", 32), strings.Repeat("k", 32), false},
+		{"short raw", "raw", "hello", "", true},
+		{"hex with newline", "hex", hexKey + "\n", hexKey, false},
+		{"hex from binary", "hex", strings.Repeat("\x0f", 32), hexKey, false},
+		{"hex too short", "hex", hexKey[:62], "", true},
+		{"not hex", "hex", strings.Repeat("zz", 32), "", true},
+		{"passphrase", "passphrase", "correct horse\n", "correct horse", false},
+		{"short passphrase", "passphrase", "short", "", true},
+		{"long passphrase", "passphrase", strings.Repeat("p", 513), "", true},
+		{"multi-line passphrase", "passphrase", "correct\nhorse", "", true},
+		{"unknown format", "base32", "hello", "", true},
+	}
+	for _, tt := range tests {
+		got, err := encodeKey([]byte(tt.key), tt.format)
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestHandler_Unlock_KeyFormat(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hexKey := strings.Repeat("ab", 32)
+	secret := base64.StdEncoding.EncodeToString([]byte(hexKey + "\n"))
+	keys := []config.APIKey{{Key: "test-key", Volumes: map[string]config.VolumeConfig{
+		"vol-hex":  {KeyFormat: "hex"},
+		"vol-pass": {KeyFormat: "passphrase"},
+	}}}
+
+	unlock := func(volumeID string, fields map[string]interface{}) *httptest.ResponseRecorder {
+		approvalSvc := approval.New()
+		mockBot := &MockNotifier{}
+		handler := New(keys, approvalSvc, &MockVault{SecretToReturn: fields}, mockBot)
+		r := gin.New()
+		handler.RegisterRoutes(r)
+
+		w := httptest.NewRecorder()
+		done := make(chan bool)
+		go func() {
+			req, _ := http.NewRequest("GET", "/v1/unlock/"+volumeID, nil)
+			req.Header.Set("Authorization", "Bearer test-key")
+			r.ServeHTTP(w, req)
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		approvalSvc.ResolveRequest(mockBot.ReqID(), true)
+		<-done
+		return w
+	}
+
+	// Declared in config: the trailing newline is stripped.
+	if w := unlock("vol-hex", map[string]interface{}{"key": secret}); w.Code != http.StatusOK || w.Body.String() != hexKey {
+		t.Errorf("Expected the hex key, got %d %q", w.Code, w.Body.String())
+	}
+	// Declared by the secret: 65 bytes are not a raw key.
+	if w := unlock("vol-other", map[string]interface{}{"key": secret, "keyformat": "raw"}); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a raw key of the wrong length, got %d", w.Code)
+	}
+	// The volume config overrides the secret's field.
+	if w := unlock("vol-pass", map[string]interface{}{"key": secret, "keyformat": "raw"}); w.Code != http.StatusOK || w.Body.String() != hexKey {
+		t.Errorf("Expected the config keyformat to win, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_RateLimit_SpoofedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := []config.APIKey{{Name: "server-01", Key: "test-key", AllowedCIDRs: []string{"10.0.0.0/8"}}}
+	mockBot := &MockNotifier{}
+	limits := config.RateLimitConfig{PerIPBurst: 100, MaxFailures: 3, BanDuration: time.Minute}
+	handler := New(keys, approval.New(), &MockVault{}, mockBot, WithRateLimit(limits))
+
+	r, err := NewRouter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.RegisterRoutes(r)
+
+	status := func(key, forwardedFor string) int {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.RemoteAddr = "203.0.113.5:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A forged client address neither passes allowed_cidrs...
+	if code := status("test-key", "10.1.2.3"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a forged allowed address, got %d", code)
+	}
+	// ...nor spreads guesses over fresh rate limit buckets.
+	for i := range 10 {
+		status("guess", fmt.Sprintf("198.51.100.%d", i))
+	}
+	if code := status("guess", "198.51.100.99"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the connection's address to be banned, got %d", code)
+	}
+}
+
+func TestHandler_RateLimit_AlertsCapped(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockBot := &MockNotifier{}
+	handler := New(nil, approval.New(), &MockVault{}, mockBot, WithRateLimit(config.RateLimitConfig{}))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+	for i := range 20 {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer guess")
+		req.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", i)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mockBot.mu.Lock()
+	defer mockBot.mu.Unlock()
+	if len(mockBot.Notices) != maxAlertsPerMinute {
+		t.Errorf("Expected %d alerts from 20 probing addresses, got %d", maxAlertsPerMinute, len(mockBot.Notices))
+	}
+}
+
+func TestHandler_RateLimitDisabled_StillAlerts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockBot := &MockNotifier{}
+	handler := New(nil, approval.New(), &MockVault{}, mockBot, WithRateLimit(config.RateLimitConfig{Disabled: true}))
+
+	r := gin.New()
+	handler.RegisterRoutes(r)
+	for range 3 {
+		req, _ := http.NewRequest("GET", "/v1/requests/unknown", nil)
+		req.Header.Set("Authorization", "Bearer guess")
+		req.RemoteAddr = "198.51.100.1:1234"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mockBot.mu.Lock()
+	defer mockBot.mu.Unlock()
+	if len(mockBot.Notices) != 1 {
+		t.Errorf("Expected one alert for the first probe without rate limiting, got %d", len(mockBot.Notices))
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Key formats of zfs load-key. A secret declares its format in a
+// "keyformat" field or through the volume's config.
+const (
+	keyFormatRaw        = "raw"
+	keyFormatHex        = "hex"
+	keyFormatPassphrase = "passphrase"
+)
+
+// Limits zfs load-key enforces; passphrase lengths are in bytes.
+const (
+	rawKeyLen        = 32
+	hexKeyLen        = 64
+	minPassphraseLen = 8
+	maxPassphraseLen = 512
+)
+
+// keyFormat returns the format declared for a volume's secret: the volume's
+// config setting, else the secret's "keyformat" field. Empty means undeclared.
+func (r *ClientRule) keyFormat(volumeID string, secret map[string]interface{}) string {
+	if f := r.Volumes[volumeID].KeyFormat; f != "" {
+		return f
+	}
+	if f, ok := secret["keyformat"].(string); ok {
+		return f
+	}
+	return ""
+}
+
+// decodeKey extracts the "key" field of a secret.
+// ZFS Compatibility: The key in Vault is always Base64 encoded.
+// We decode it and, if the secret declares a keyformat, check the key
+// against it and return it as zfs load-key reads that format.
+func decodeKey(secret map[string]interface{}, format string) ([]byte, bool, error) {
+	val, ok := secret["key"]
+	if !ok {
+		return nil, false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(fmt.Sprintf("%v", val))
+	if err != nil {
+		return nil, true, err
+	}
+	key, err := encodeKey(decoded, format)
+	return key, true, err
+}
+
+// encodeKey checks key against format and returns it the way zfs load-key
+// reads that format. A 32 byte binary key is hex-encoded for the hex format;
+// everything else is only validated. Undeclared formats pass through as-is.
+func encodeKey(key []byte, format string) ([]byte, error) {
+	switch format {
+	case "":
+		return key, nil
+	case keyFormatRaw:
+		if len(key) != rawKeyLen {
+			return nil, fmt.Errorf("raw key must be %d bytes, got %d", rawKeyLen, len(key))
+		}
+		return key, nil
+	case keyFormatHex:
+		if len(key) == rawKeyLen {
+			return []byte(hex.EncodeToString(key)), nil
+		}
+		// Files written with echo end in a newline; zfs does not want it.
+		key = bytes.TrimRight(key, "\r\n")
+		if len(key) != hexKeyLen {
+			return nil, fmt.Errorf("hex key must be %d characters, got %d", hexKeyLen, len(key))
+		}
+		if _, err := hex.Decode(make([]byte, hexKeyLen/2), key); err != nil {
+			return nil, fmt.Errorf("invalid hex key: %w", err)
+		}
+		return key, nil
+	case keyFormatPassphrase:
+		key = bytes.TrimRight(key, "\r\n")
+		if len(key) < minPassphraseLen || len(key) > maxPassphraseLen {
+			return nil, fmt.Errorf("passphrase must be %d to %d bytes, got %d", minPassphraseLen, maxPassphraseLen, len(key))
+		}
+		// zfs load-key -L prompt reads a single line.
+		if bytes.ContainsAny(key, "\r\n") {
+			return nil, fmt.Errorf("passphrase must not contain line breaks")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unknown keyformat %q", format)
+	}
+}
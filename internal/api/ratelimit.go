@@ -0,0 +1,283 @@
+package api
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Rate limit defaults, used for zero values in config.RateLimitConfig.
+const (
+	defaultPerIP       = 1
+	defaultPerIPBurst  = 10
+	defaultPerKey      = 1
+	defaultPerKeyBurst = 10
+	defaultMaxFailures = 5
+	defaultBanDuration = 15 * time.Minute
+
+	// idleClientTTL is how long per-IP state is kept after the last request.
+	idleClientTTL = 30 * time.Minute
+
+	// Probe and ban alerts sent to Telegram per minute; the rest are counted
+	// and mentioned in the next alert that goes out.
+	maxAlertsPerMinute = 5
+)
+
+// rateLimiter throttles requests per client IP and per API key and bans
+// addresses after repeated authentication failures. A nil *rateLimiter
+// allows everything.
+type rateLimiter struct {
+	perIP       rate.Limit
+	perIPBurst  int
+	perKey      rate.Limit
+	perKeyBurst int
+	maxFailures int
+	banDuration time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	keys      map[string]*rate.Limiter
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type clientState struct {
+	limiter      *rate.Limiter
+	failures     int
+	firstFailure time.Time
+	bannedUntil  time.Time
+	lastSeen     time.Time
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	if cfg.Disabled {
+		return nil
+	}
+	return &rateLimiter{
+		perIP:       rate.Limit(cmp.Or(cfg.PerIP, defaultPerIP)),
+		perIPBurst:  cmp.Or(cfg.PerIPBurst, defaultPerIPBurst),
+		perKey:      rate.Limit(cmp.Or(cfg.PerKey, defaultPerKey)),
+		perKeyBurst: cmp.Or(cfg.PerKeyBurst, defaultPerKeyBurst),
+		maxFailures: cmp.Or(cfg.MaxFailures, defaultMaxFailures),
+		banDuration: cmp.Or(cfg.BanDuration, defaultBanDuration),
+		clients:     make(map[string]*clientState),
+		keys:        make(map[string]*rate.Limiter),
+		now:         time.Now,
+	}
+}
+
+// client returns the state for ip, creating it if needed. l.mu must be held.
+func (l *rateLimiter) client(ip string, now time.Time) *clientState {
+	l.pruneLocked(now)
+	cs, ok := l.clients[ip]
+	if !ok {
+		cs = &clientState{limiter: rate.NewLimiter(l.perIP, l.perIPBurst)}
+		l.clients[ip] = cs
+	}
+	cs.lastSeen = now
+	return cs
+}
+
+// pruneLocked drops idle, unbanned clients at most once a minute so the map
+// cannot grow without bound.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for ip, cs := range l.clients {
+		if now.Sub(cs.lastSeen) > idleClientTTL && now.After(cs.bannedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// allowIP reports whether a request from ip may proceed. If not, it returns
+// how long the client should wait before retrying.
+func (l *rateLimiter) allowIP(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cs := l.client(ip, now)
+	if now.Before(cs.bannedUntil) {
+		return false, cs.bannedUntil.Sub(now)
+	}
+	r := cs.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// allowKey reports whether another request authenticated with the named key
+// may proceed.
+func (l *rateLimiter) allowKey(name string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.keys[name]
+	if !ok {
+		lim = rate.NewLimiter(l.perKey, l.perKeyBurst)
+		l.keys[name] = lim
+	}
+	return lim.AllowN(l.now(), 1)
+}
+
+// fail records an authentication failure from ip and reports whether it
+// triggered a ban.
+func (l *rateLimiter) fail(ip string) (banned bool) {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cs := l.client(ip, now)
+	if cs.failures == 0 || now.Sub(cs.firstFailure) > l.banDuration {
+		cs.failures = 0
+		cs.firstFailure = now
+	}
+	cs.failures++
+	if cs.failures < l.maxFailures {
+		return false
+	}
+	cs.failures = 0
+	cs.bannedUntil = now.Add(l.banDuration)
+	return true
+}
+
+// probeAlerts decides which failed authentications are announced: the first
+// from an address within a window, at most maxAlertsPerMinute a minute. It
+// works whether rate limiting is enabled or not.
+type probeAlerts struct {
+	window time.Duration
+
+	mu         sync.Mutex
+	probes     map[string]time.Time // address -> first failure in its window
+	lastPrune  time.Time
+	limiter    *rate.Limiter
+	suppressed int // alerts dropped since the last one sent
+	now        func() time.Time
+}
+
+func newProbeAlerts(window time.Duration) *probeAlerts {
+	return &probeAlerts{
+		window:  window,
+		probes:  make(map[string]time.Time),
+		limiter: rate.NewLimiter(rate.Every(time.Minute/maxAlertsPerMinute), maxAlertsPerMinute),
+		now:     time.Now,
+	}
+}
+
+// first reports whether this failure from ip is the first in its window.
+func (a *probeAlerts) first(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if now.Sub(a.lastPrune) >= time.Minute {
+		a.lastPrune = now
+		for addr, t := range a.probes {
+			if now.Sub(t) > a.window {
+				delete(a.probes, addr)
+			}
+		}
+	}
+	if t, ok := a.probes[ip]; ok && now.Sub(t) <= a.window {
+		return false
+	}
+	a.probes[ip] = now
+	return true
+}
+
+// allow reports whether another alert may be sent, and how many were
+// suppressed since the last one.
+func (a *probeAlerts) allow() (bool, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.limiter.AllowN(a.now(), 1) {
+		a.suppressed++
+		return false, 0
+	}
+	suppressed := a.suppressed
+	a.suppressed = 0
+	return true, suppressed
+}
+
+// rateLimitMiddleware rejects banned and over-limit clients before their
+// credentials are checked.
+func (h *Handler) rateLimitMiddleware(c *gin.Context) {
+	if ok, retry := h.limiter.allowIP(c.ClientIP()); !ok {
+		tooManyRequests(c, retry)
+		return
+	}
+	c.Next()
+}
+
+func tooManyRequests(c *gin.Context, retry time.Duration) {
+	if retry > 0 {
+		secs := int((retry + time.Second - 1) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(secs))
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+}
+
+// recordProbe counts a failed authentication towards a ban and alerts the
+// Telegram chat on the first failure from an address and when it is banned,
+// at most maxAlertsPerMinute times a minute. Alerts are sent even when rate
+// limiting is disabled.
+func (h *Handler) recordProbe(c *gin.Context, keyName, reason string) {
+	ip := c.ClientIP()
+	banned := h.limiter.fail(ip)
+
+	var text string
+	switch {
+	case banned:
+		log.Printf("Banned %s for %v after repeated authentication failures", ip, h.limiter.banDuration)
+		h.auditLog.Record(audit.Event{
+			Type:     audit.EventClientBanned,
+			APIKey:   keyName,
+			ClientIP: ip,
+			Detail:   fmt.Sprintf("%d failures, banned for %v", h.limiter.maxFailures, h.limiter.banDuration),
+		})
+		text = fmt.Sprintf("🚫 Banned %s for %v after %d failed authentication attempts.",
+			ip, h.limiter.banDuration, h.limiter.maxFailures)
+	case h.probes.first(ip):
+		text = fmt.Sprintf("🔎 Rejected request from %s: %s (%s %s).", ip, reason, c.Request.Method, c.FullPath())
+		if keyName != "" {
+			text = fmt.Sprintf("🔎 Rejected request for API key %s from %s: %s (%s %s).",
+				keyName, ip, reason, c.Request.Method, c.FullPath())
+		}
+	default:
+		return
+	}
+	ok, suppressed := h.probes.allow()
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		text += fmt.Sprintf(" %d more alerts were suppressed.", suppressed)
+	}
+	// Do not let a slow Telegram API hold up the response.
+	go h.notify(ip, text)
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"zfs-unlocker/internal/approval"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxWait caps the long-poll duration accepted by handleGetRequest.
+const maxWait = 60 * time.Second
+
+// createRequestBody names either a single volume or, for a batch, several.
+type createRequestBody struct {
+	VolumeID string   `json:"volume_id"`
+	Volumes  []string `json:"volumes"`
+	Version  int      `json:"version" binding:"min=0"` // secret version of volume_id; 0 means latest or the configured pin
+}
+
+type requestResponse struct {
+	ID        string            `json:"id"`
+	VolumeID  string            `json:"volume_id"`
+	Status    approval.Status   `json:"status"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Key       []byte            `json:"key,omitempty"`      // base64 encoded in JSON
+	Keys      map[string][]byte `json:"keys,omitempty"`     // batch requests: volume ID -> key
+	Excluded  []string          `json:"excluded,omitempty"` // batch volumes the approvers left out
+}
+
+// handleCreateRequest starts an approval for one volume or a batch and returns
+// its ID without waiting for a decision.
+func (h *Handler) handleCreateRequest(c *gin.Context) {
+	ruleObj, _ := c.Get("clientRule")
+	rule := ruleObj.(*ClientRule)
+
+	var body createRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil || (body.VolumeID == "") == (len(body.Volumes) == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set either volume_id or volumes, with a valid version"})
+		return
+	}
+
+	var reqID string
+	var err error
+	if len(body.Volumes) > 0 {
+		if body.Version != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Versions are only supported for a single volume"})
+			return
+		}
+		volumes, msg := batchVolumes(body.Volumes)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		reqID, _, err = h.startBatch(c, rule, volumes, true)
+	} else {
+		if !validVolumeIDs([]string{body.VolumeID}) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid volume ID"})
+			return
+		}
+		reqID, _, err = h.startRequest(c, rule, body.VolumeID, body.Version, true)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send approval request"})
+		return
+	}
+
+	req, _ := h.approvalService.Get(reqID)
+	c.JSON(http.StatusAccepted, requestResponse{
+		ID:        req.ID,
+		VolumeID:  req.VolumeID,
+		Status:    req.Status,
+		ExpiresAt: req.ExpiresAt,
+	})
+}
+
+// handleGetRequest reports the state of a request, optionally long-polling
+// with ?wait=30s, and delivers the key once the request is approved. Batch
+// requests get the key of every selected volume in Keys. Keys are only
+// delivered once; later calls get 410 Gone with the status alone.
+func (h *Handler) handleGetRequest(c *gin.Context) {
+	ruleObj, _ := c.Get("clientRule")
+	rule := ruleObj.(*ClientRule)
+
+	var wait time.Duration
+	if w := c.Query("wait"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wait duration"})
+			return
+		}
+		wait = min(d, maxWait)
+	}
+
+	reqID := c.Param("id")
+	req, found := h.approvalService.Get(reqID)
+	// Requests are only visible to the API key that created them.
+	if !found || req.APIKey != c.GetString("keyName") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return
+	}
+
+	if req.Status == approval.StatusPending && wait > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		req, _ = h.approvalService.Wait(ctx, reqID)
+		cancel()
+	}
+
+	resp := requestResponse{
+		ID:        req.ID,
+		VolumeID:  req.VolumeID,
+		Status:    req.Status,
+		ExpiresAt: req.ExpiresAt,
+		Excluded:  req.Excluded,
+	}
+	if req.Status != approval.StatusApproved {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	if !h.approvalService.ClaimDelivery(req.ID) {
+		c.JSON(http.StatusGone, resp)
+		return
+	}
+
+	if len(req.Volumes) > 0 {
+		keys, err := h.batchKeys(c.Request.Context(), rule, req)
+		if err != nil {
+			h.approvalService.ReleaseDelivery(req.ID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Approved, but " + err.Error()})
+			return
+		}
+		resp.Keys = keys
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	secret, err := h.fetchSecret(c.Request.Context(), rule, req)
+	if err != nil {
+		h.approvalService.ReleaseDelivery(req.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Approved, but failed to fetch secret"})
+		return
+	}
+	key, found, err := decodeKey(secret, rule.keyFormat(req.VolumeID, secret))
+	if err != nil || !found {
+		h.approvalService.ReleaseDelivery(req.ID)
+		log.Printf("Secret for %s has no usable key field: %v", req.VolumeID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode key"})
+		return
+	}
+
+	if c.GetHeader("Accept") == "application/octet-stream" {
+		c.Data(http.StatusOK, "application/octet-stream", key)
+		return
+	}
+	resp.Key = key
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,197 @@
+// Package apikey generates API keys and verifies them against stored hashes.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported hash algorithms.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+	SHA256   = "sha256"
+)
+
+// argon2id parameters for newly generated hashes (RFC 9106 second recommendation).
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+
+	// argonMaxMemory caps the memory, in KiB, a configured hash may demand
+	// on every verification.
+	argonMaxMemory = 1024 * 1024
+)
+
+// idLen is the length in bytes of a generated key ID, before hex encoding.
+const idLen = 4
+
+var ErrUnknownFormat = errors.New("unknown key hash format")
+
+// Generate returns a new random API key.
+func Generate() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// GenerateWithID returns a new random API key of the form "<id>.<secret>".
+// The ID tells the server which hash to check, so a presented key costs at
+// most one slow verification.
+func GenerateWithID() (id, key string, err error) {
+	buf := make([]byte, idLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate key ID: %w", err)
+	}
+	secret, err := Generate()
+	if err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(buf)
+	return id, id + "." + secret, nil
+}
+
+// ID returns the ID part of a key generated by GenerateWithID, or "" if the
+// key carries none. Generated secrets never contain a dot.
+func ID(key string) string {
+	id, _, ok := strings.Cut(key, ".")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// Hash hashes key with the given algorithm, in the format Verify understands.
+func Hash(alg, key string) (string, error) {
+	switch alg {
+	case Argon2id:
+		salt := make([]byte, argonSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		sum := argon2.IDKey([]byte(key), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum)), nil
+	case Bcrypt:
+		sum, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(sum), nil
+	case SHA256:
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unsupported hash algorithm %q", alg)
+}
+
+// Verify reports whether key matches hash. Comparisons run in constant time.
+func Verify(hash, key string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, key)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(key))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "sha256:"):
+		want, err := hex.DecodeString(strings.TrimPrefix(hash, "sha256:"))
+		if err != nil || len(want) != sha256.Size {
+			return false, fmt.Errorf("invalid sha256 key hash")
+		}
+		sum := sha256.Sum256([]byte(key))
+		return subtle.ConstantTimeCompare(sum[:], want) == 1, nil
+	}
+	return false, ErrUnknownFormat
+}
+
+// IsSlow reports whether hash uses a deliberately slow algorithm (argon2id or
+// bcrypt), which must not be checked for every presented key.
+func IsSlow(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// CheckFormat returns an error if hash is not in a format Verify understands.
+func CheckFormat(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, _, _, err := parseArgon2id(hash)
+		return err
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "sha256:"):
+		_, err := Verify(hash, "")
+		return err
+	}
+	return ErrUnknownFormat
+}
+
+type argonParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2id(hash string) (argonParams, []byte, []byte, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id key hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argonParams{}, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	var p argonParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	// argon2.IDKey panics on out-of-range parameters.
+	switch {
+	case p.time < 1 || p.threads < 1:
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id parameters: t and p must be at least 1")
+	case p.memory < 8*uint32(p.threads):
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id parameters: m must be at least 8*p")
+	case p.memory > argonMaxMemory:
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id parameters: m must be at most %d", argonMaxMemory)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(sum) == 0 {
+		return argonParams{}, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	return p, salt, sum, nil
+}
+
+func verifyArgon2id(hash, key string) (bool, error) {
+	p, salt, want, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	sum := argon2.IDKey([]byte(key), salt, p.time, p.memory, p.threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(sum, want) == 1, nil
+}
@@ -0,0 +1,79 @@
+package apikey
+
+import (
+	"testing"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	key, err := Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	for _, alg := range []string{Argon2id, Bcrypt, SHA256} {
+		t.Run(alg, func(t *testing.T) {
+			hash, err := Hash(alg, key)
+			if err != nil {
+				t.Fatalf("Hash failed: %v", err)
+			}
+			if err := CheckFormat(hash); err != nil {
+				t.Errorf("CheckFormat rejected generated hash: %v", err)
+			}
+
+			ok, err := Verify(hash, key)
+			if err != nil || !ok {
+				t.Errorf("Expected key to verify, got ok=%v err=%v", ok, err)
+			}
+			ok, err = Verify(hash, key+"x")
+			if err != nil || ok {
+				t.Errorf("Expected wrong key to be rejected, got ok=%v err=%v", ok, err)
+			}
+		})
+	}
+}
+
+func TestVerify_UnknownFormat(t *testing.T) {
+	if _, err := Verify("md5:abc", "key"); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+	if err := CheckFormat("$argon2id$v=19$garbage"); err == nil {
+		t.Error("Expected malformed argon2id hash to be rejected")
+	}
+}
+
+func TestVerify_Argon2idParameters(t *testing.T) {
+	const tail = "$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA"
+	for _, params := range []string{"m=65536,t=0,p=4", "m=65536,t=3,p=0", "m=16,t=3,p=4", "m=4294967295,t=1,p=1"} {
+		hash := "$argon2id$v=19$" + params + tail
+		if err := CheckFormat(hash); err == nil {
+			t.Errorf("Expected %s to be rejected by CheckFormat", params)
+		}
+		if _, err := Verify(hash, "key"); err == nil {
+			t.Errorf("Expected %s to be rejected by Verify", params)
+		}
+	}
+	if err := CheckFormat("$argon2id$v=19$m=65536,t=3,p=4" + tail); err != nil {
+		t.Errorf("Expected valid parameters to be accepted, got %v", err)
+	}
+}
+
+func TestGenerateWithID(t *testing.T) {
+	id, key, err := GenerateWithID()
+	if err != nil {
+		t.Fatalf("GenerateWithID failed: %v", err)
+	}
+	if len(id) != 8 || ID(key) != id {
+		t.Errorf("Expected an 8 character ID prefixing the key, got %q in %q", id, key)
+	}
+	if plain, _ := Generate(); ID(plain) != "" {
+		t.Errorf("Expected no ID in a plain key, got %q", ID(plain))
+	}
+}
+
+func TestGenerate_Unique(t *testing.T) {
+	a, _ := Generate()
+	b, _ := Generate()
+	if a == b || len(a) != 43 {
+		t.Errorf("Expected distinct 43 character keys, got %q and %q", a, b)
+	}
+}
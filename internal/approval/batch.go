@@ -0,0 +1,77 @@
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"zfs-unlocker/internal/audit"
+)
+
+var (
+	ErrLastVolume = errors.New("at least one volume must stay selected")
+	ErrVotesCast  = errors.New("the selection cannot change after votes were cast")
+)
+
+// SelectedVolumes returns the volumes an approval covers: the volumes of a
+// batch request that approvers did not deselect, or the single VolumeID.
+func (r Request) SelectedVolumes() []string {
+	if len(r.Volumes) == 0 {
+		return []string{r.VolumeID}
+	}
+	selected := make([]string, 0, len(r.Volumes))
+	for _, v := range r.Volumes {
+		if !slices.Contains(r.Excluded, v) {
+			selected = append(selected, v)
+		}
+	}
+	return selected
+}
+
+// ToggleVolume includes or excludes the volume at index idx of a pending
+// batch request, letting approvers approve only a subset. The selection is
+// fixed once the first vote is cast, so every vote covers the same volumes.
+func (s *Service) ToggleVolume(reqID string, idx int, voter Voter) (Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, exists := s.pendingRequests[reqID]
+	if !exists {
+		return Request{}, ErrNotPending
+	}
+	if approvers := p.req.Policy.Approvers; len(approvers) > 0 && !slices.Contains(approvers, voter.ID) {
+		return p.req, ErrNotApprover
+	}
+	if len(p.req.Votes) > 0 {
+		return p.req, ErrVotesCast
+	}
+	if idx < 0 || idx >= len(p.req.Volumes) {
+		return p.req, fmt.Errorf("request %s has no volume %d", reqID, idx)
+	}
+
+	// Copies of the request handed out by Get, Pending and the memory store
+	// share the slice, so it is replaced rather than modified in place.
+	volume := p.req.Volumes[idx]
+	outcome := "excluded"
+	if i := slices.Index(p.req.Excluded, volume); i >= 0 {
+		p.req.Excluded = slices.Delete(slices.Clone(p.req.Excluded), i, i+1)
+		outcome = "included"
+	} else {
+		if len(p.req.SelectedVolumes()) == 1 {
+			return p.req, ErrLastVolume
+		}
+		p.req.Excluded = append(slices.Clone(p.req.Excluded), volume)
+	}
+	s.persist(p.req)
+
+	s.auditLog.Record(audit.Event{
+		Type:      audit.EventVolumeToggled,
+		RequestID: reqID,
+		VolumeID:  volume,
+		Actor:     fmt.Sprintf("%s (%d)", voter.Name, voter.ID),
+		Outcome:   outcome,
+	})
+	log.Printf("Volume %s %s from request %s by %s", volume, outcome, reqID, voter.Name)
+	return p.req, nil
+}
@@ -0,0 +1,86 @@
+package approval
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestService_ToggleVolume(t *testing.T) {
+	svc := New()
+	reqID, ch := svc.NewRequest(Request{VolumeID: "a,b", Volumes: []string{"a", "b"}})
+	alice := Voter{ID: 1, Name: "alice"}
+
+	req, err := svc.ToggleVolume(reqID, 1, alice)
+	if err != nil || !slices.Equal(req.SelectedVolumes(), []string{"a"}) {
+		t.Fatalf("Expected only a to stay selected, got %v (err %v)", req.SelectedVolumes(), err)
+	}
+	if _, err := svc.ToggleVolume(reqID, 0, alice); !errors.Is(err, ErrLastVolume) {
+		t.Errorf("Expected ErrLastVolume when deselecting the last volume, got %v", err)
+	}
+	if _, err := svc.ToggleVolume(reqID, 5, alice); err == nil {
+		t.Error("Expected an error for an unknown volume index")
+	}
+
+	// Toggling again brings the volume back.
+	req, _ = svc.ToggleVolume(reqID, 1, alice)
+	if !slices.Equal(req.SelectedVolumes(), []string{"a", "b"}) {
+		t.Errorf("Expected both volumes selected again, got %v", req.SelectedVolumes())
+	}
+
+	svc.ToggleVolume(reqID, 0, alice)
+	svc.Vote(reqID, alice, true)
+	<-ch
+	req, _ = svc.Get(reqID)
+	if !slices.Equal(req.SelectedVolumes(), []string{"b"}) {
+		t.Errorf("Expected the decision to cover only b, got %v", req.SelectedVolumes())
+	}
+	if _, err := svc.ToggleVolume(reqID, 0, alice); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Expected ErrNotPending after the decision, got %v", err)
+	}
+}
+
+func TestService_ToggleVolumeAfterVote(t *testing.T) {
+	svc := New()
+	reqID, ch := svc.NewRequest(Request{VolumeID: "a,b", Volumes: []string{"a", "b"}, Policy: Policy{RequiredApprovals: 2}})
+	alice := Voter{ID: 1, Name: "alice"}
+	bob := Voter{ID: 2, Name: "bob"}
+
+	svc.Vote(reqID, alice, true)
+	// Bob must not narrow the selection alice approved.
+	if _, err := svc.ToggleVolume(reqID, 1, bob); !errors.Is(err, ErrVotesCast) {
+		t.Errorf("Expected ErrVotesCast after a vote, got %v", err)
+	}
+
+	svc.Vote(reqID, bob, true)
+	<-ch
+	req, _ := svc.Get(reqID)
+	if !slices.Equal(req.SelectedVolumes(), []string{"a", "b"}) {
+		t.Errorf("Expected the decision to cover the voted selection, got %v", req.SelectedVolumes())
+	}
+}
+
+func TestService_ToggleVolumeKeepsSnapshots(t *testing.T) {
+	svc := New()
+	reqID, _ := svc.NewRequest(Request{VolumeID: "a,b,c", Volumes: []string{"a", "b", "c"}})
+	alice := Voter{ID: 1, Name: "alice"}
+	svc.ToggleVolume(reqID, 0, alice)
+	svc.ToggleVolume(reqID, 1, alice)
+
+	snapshot, _ := svc.Get(reqID)
+	svc.ToggleVolume(reqID, 0, alice)
+	svc.ToggleVolume(reqID, 2, alice)
+	if !slices.Equal(snapshot.Excluded, []string{"a", "b"}) {
+		t.Errorf("Expected the earlier snapshot to keep its excluded volumes, got %v", snapshot.Excluded)
+	}
+	if req, _ := svc.Get(reqID); !slices.Equal(req.Excluded, []string{"b", "c"}) {
+		t.Errorf("Expected b and c excluded, got %v", req.Excluded)
+	}
+}
+
+func TestRequest_SelectedVolumesSingle(t *testing.T) {
+	req := Request{VolumeID: "vol"}
+	if got := req.SelectedVolumes(); !slices.Equal(got, []string{"vol"}) {
+		t.Errorf("Expected the single volume, got %v", got)
+	}
+}
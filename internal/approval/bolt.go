@@ -0,0 +1,124 @@
+package approval
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	requestsBucket = []byte("requests")
+	grantsBucket   = []byte("grants")
+)
+
+// BoltStore persists requests in an embedded bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{requestsBucket, grantsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state database: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) Put(req Request) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).Put([]byte(req.ID), data)
+	})
+}
+
+func (b *BoltStore) Get(id string) (Request, bool, error) {
+	var req Request
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(requestsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &req)
+	})
+	if err != nil {
+		return Request{}, false, fmt.Errorf("failed to read request %s: %w", id, err)
+	}
+	return req, found, nil
+}
+
+func (b *BoltStore) List() ([]Request, error) {
+	var reqs []Request
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).ForEach(func(k, v []byte) error {
+			var req Request
+			if err := json.Unmarshal(v, &req); err != nil {
+				return fmt.Errorf("failed to decode request %s: %w", k, err)
+			}
+			reqs = append(reqs, req)
+			return nil
+		})
+	})
+	return reqs, err
+}
+
+func (b *BoltStore) Delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStore) PutGrant(g Grant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("failed to encode grant: %w", err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(grantsBucket).Put([]byte(g.ID), data)
+	})
+}
+
+func (b *BoltStore) ListGrants() ([]Grant, error) {
+	var grants []Grant
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(grantsBucket).ForEach(func(k, v []byte) error {
+			var g Grant
+			if err := json.Unmarshal(v, &g); err != nil {
+				return fmt.Errorf("failed to decode grant %s: %w", k, err)
+			}
+			grants = append(grants, g)
+			return nil
+		})
+	})
+	return grants, err
+}
+
+func (b *BoltStore) DeleteGrant(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(grantsBucket).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
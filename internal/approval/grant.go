@@ -0,0 +1,163 @@
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"zfs-unlocker/internal/audit"
+
+	"github.com/google/uuid"
+)
+
+// MaxGrantDuration bounds how long a pre-approval can stay valid.
+const MaxGrantDuration = 7 * 24 * time.Hour
+
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// Grant pre-approves requests during a maintenance window. Every request whose
+// API key name or client IP equals Subject and whose volumes all match
+// Volumes is approved on creation until the grant expires or is revoked.
+// A grant stands in for its creator's single approval, so requests needing a
+// quorum, or whose approvers do not include the creator, still go to a vote.
+type Grant struct {
+	ID        string    `json:"id"`
+	Subject   string    `json:"subject"` // API key name or client IP
+	Volumes   string    `json:"volumes"` // volume ID glob
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy Voter     `json:"created_by"`
+}
+
+func (g Grant) matches(req Request) bool {
+	if req.Policy.RequiredApprovals > 1 {
+		return false
+	}
+	if approvers := req.Policy.Approvers; len(approvers) > 0 && !slices.Contains(approvers, g.CreatedBy.ID) {
+		return false
+	}
+	if g.Subject != req.APIKey && g.Subject != req.ClientIP {
+		return false
+	}
+	for _, v := range req.SelectedVolumes() {
+		if ok, _ := path.Match(g.Volumes, v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// AddGrant pre-approves requests from subject for volumes matching the glob
+// for the given duration.
+func (s *Service) AddGrant(subject, volumes string, d time.Duration, by Voter) (Grant, error) {
+	if subject == "" {
+		return Grant{}, fmt.Errorf("%w: missing API key name or host", ErrInvalidGrant)
+	}
+	if _, err := path.Match(volumes, ""); err != nil {
+		return Grant{}, fmt.Errorf("%w: bad volume glob %q", ErrInvalidGrant, volumes)
+	}
+	// Volume IDs are single path segments (tank/secure is requested as
+	// tank-secure), so a glob with a slash would never match anything.
+	if strings.Contains(volumes, "/") {
+		return Grant{}, fmt.Errorf("%w: volume glob %q must not contain \"/\"; volume IDs are single segments such as tank-secure, so match them with e.g. tank-*", ErrInvalidGrant, volumes)
+	}
+	if d <= 0 || d > MaxGrantDuration {
+		return Grant{}, fmt.Errorf("%w: duration must be between 0 and %v", ErrInvalidGrant, MaxGrantDuration)
+	}
+
+	now := time.Now()
+	g := Grant{
+		ID:        uuid.New().String()[:8],
+		Subject:   subject,
+		Volumes:   volumes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(d),
+		CreatedBy: by,
+	}
+
+	s.mu.Lock()
+	s.grants[g.ID] = g
+	if err := s.store.PutGrant(g); err != nil {
+		log.Printf("Failed to persist grant %s: %v", g.ID, err)
+	}
+	s.mu.Unlock()
+
+	s.auditLog.Record(audit.Event{
+		Type:     audit.EventGrantCreated,
+		APIKey:   subject,
+		VolumeID: volumes,
+		Actor:    fmt.Sprintf("%s (%d)", by.Name, by.ID),
+		Detail:   fmt.Sprintf("grant %s until %s", g.ID, g.ExpiresAt.UTC().Format(time.RFC3339)),
+	})
+	log.Printf("Grant %s created by %s: %s %s until %s", g.ID, by.Name, subject, volumes, g.ExpiresAt.Format(time.RFC3339))
+	return g, nil
+}
+
+// Grants returns the active grants, soonest to expire first.
+func (s *Service) Grants() []Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneGrantsLocked(time.Now())
+	grants := make([]Grant, 0, len(s.grants))
+	for _, g := range s.grants {
+		grants = append(grants, g)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].ExpiresAt.Before(grants[j].ExpiresAt) })
+	return grants
+}
+
+// RevokeGrant removes a grant before it expires.
+func (s *Service) RevokeGrant(id string, by Voter) bool {
+	s.mu.Lock()
+	g, exists := s.grants[id]
+	if exists {
+		s.deleteGrantLocked(id)
+	}
+	s.mu.Unlock()
+	if !exists {
+		return false
+	}
+
+	s.auditLog.Record(audit.Event{
+		Type:     audit.EventGrantRevoked,
+		APIKey:   g.Subject,
+		VolumeID: g.Volumes,
+		Actor:    fmt.Sprintf("%s (%d)", by.Name, by.ID),
+		Detail:   "grant " + id,
+	})
+	log.Printf("Grant %s revoked by %s", id, by.Name)
+	return true
+}
+
+// grantFor returns an active grant covering req. Callers must hold s.mu.
+func (s *Service) grantFor(req Request) (Grant, bool) {
+	s.pruneGrantsLocked(req.CreatedAt)
+	for _, g := range s.grants {
+		if g.matches(req) {
+			return g, true
+		}
+	}
+	return Grant{}, false
+}
+
+// pruneGrantsLocked drops grants that expired before now. Callers must hold s.mu.
+func (s *Service) pruneGrantsLocked(now time.Time) {
+	for id, g := range s.grants {
+		if !now.Before(g.ExpiresAt) {
+			s.deleteGrantLocked(id)
+		}
+	}
+}
+
+func (s *Service) deleteGrantLocked(id string) {
+	delete(s.grants, id)
+	if err := s.store.DeleteGrant(id); err != nil {
+		log.Printf("Failed to delete grant %s: %v", id, err)
+	}
+}
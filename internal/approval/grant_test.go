@@ -0,0 +1,119 @@
+package approval
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestService_GrantPreApproves(t *testing.T) {
+	svc := New()
+	admin := Voter{ID: 1, Name: "alice"}
+
+	g, err := svc.AddGrant("server-01", "tank-*", time.Hour, admin)
+	if err != nil {
+		t.Fatalf("AddGrant failed: %v", err)
+	}
+
+	reqID, ch := svc.NewRequest(Request{VolumeID: "tank-data", APIKey: "server-01", ClientIP: "10.0.0.1"})
+	if approved := <-ch; !approved {
+		t.Fatal("Expected request covered by the grant to be approved")
+	}
+	req, _ := svc.Get(reqID)
+	if req.Grant != g.ID || req.DeciderNames() != "alice" {
+		t.Errorf("Expected decision by grant %s from alice, got grant %q by %q", g.ID, req.Grant, req.DeciderNames())
+	}
+
+	// Grants match on the client IP as well as the key name.
+	if _, err := svc.AddGrant("10.0.0.2", "*", time.Hour, admin); err != nil {
+		t.Fatal(err)
+	}
+	_, ch = svc.NewRequest(Request{VolumeID: "other", APIKey: "server-02", ClientIP: "10.0.0.2"})
+	if approved := <-ch; !approved {
+		t.Error("Expected grant for the client IP to approve the request")
+	}
+
+	otherID, _ := svc.NewRequest(Request{VolumeID: "backup-data", APIKey: "server-01", ClientIP: "10.0.0.1"})
+	if req, _ := svc.Get(otherID); req.Status != StatusPending {
+		t.Errorf("Expected volume outside the glob to stay pending, got %s", req.Status)
+	}
+
+	if !svc.RevokeGrant(g.ID, admin) || svc.RevokeGrant(g.ID, admin) {
+		t.Error("Expected grant to be revoked exactly once")
+	}
+	revokedID, _ := svc.NewRequest(Request{VolumeID: "tank-data", APIKey: "server-01", ClientIP: "10.0.0.1"})
+	if req, _ := svc.Get(revokedID); req.Status != StatusPending {
+		t.Errorf("Expected revoked grant to approve nothing, got %s", req.Status)
+	}
+}
+
+func TestService_GrantValidation(t *testing.T) {
+	svc := New()
+	for _, tt := range []struct {
+		subject, volumes string
+		d                time.Duration
+	}{
+		{"", "*", time.Hour},
+		{"server-01", "[", time.Hour},
+		{"server-01", "tank/*", time.Hour},
+		{"server-01", "*", 0},
+		{"server-01", "*", MaxGrantDuration + time.Hour},
+	} {
+		if _, err := svc.AddGrant(tt.subject, tt.volumes, tt.d, Voter{}); !errors.Is(err, ErrInvalidGrant) {
+			t.Errorf("Expected ErrInvalidGrant for %+v, got %v", tt, err)
+		}
+	}
+}
+
+func TestService_GrantsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := New(WithStore(store)).AddGrant("server-01", "*", time.Hour, Voter{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	svc := New(WithStore(store))
+	if _, err := svc.Restore(); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if grants := svc.Grants(); len(grants) != 1 || grants[0].ID != g.ID {
+		t.Errorf("Expected grant %s to be restored, got %+v", g.ID, grants)
+	}
+}
+
+func TestService_GrantRespectsPolicy(t *testing.T) {
+	svc := New()
+	if _, err := svc.AddGrant("server-01", "tank-*", time.Hour, Voter{ID: 9, Name: "mallory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy Policy
+	}{
+		{"quorum", Policy{RequiredApprovals: 2, DenyVeto: true}},
+		{"creator not an approver", Policy{RequiredApprovals: 1, Approvers: []int64{1, 2, 3}, DenyVeto: true}},
+	} {
+		reqID, _ := svc.NewRequest(Request{VolumeID: "tank-data", APIKey: "server-01", Policy: tt.policy})
+		if req, _ := svc.Get(reqID); req.Status != StatusPending || req.Grant != "" {
+			t.Errorf("%s: expected the grant not to apply, got %s by grant %q", tt.name, req.Status, req.Grant)
+		}
+	}
+
+	// A single-approval policy listing the creator is covered.
+	reqID, _ := svc.NewRequest(Request{VolumeID: "tank-data", APIKey: "server-01", Policy: Policy{RequiredApprovals: 1, Approvers: []int64{9}}})
+	if req, _ := svc.Get(reqID); req.Status != StatusApproved {
+		t.Errorf("Expected the grant to approve a policy its creator can satisfy, got %s", req.Status)
+	}
+}
@@ -1,59 +1,632 @@
 package approval
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/metrics"
+
 	"github.com/google/uuid"
 )
 
+// DefaultTimeout is how long a request stays pending before it expires,
+// unless the request or WithDefaultTimeout says otherwise.
+const DefaultTimeout = 5 * time.Minute
+
+// retention is how long decided requests are kept in the store.
+const retention = 30 * 24 * time.Hour
+
+// pruneInterval is how often decided requests past retention are removed.
+const pruneInterval = time.Hour
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusApproved  Status = "approved"
+	StatusDenied    Status = "denied"
+	StatusExpired   Status = "expired"
+	StatusCancelled Status = "cancelled" // the server shut down before a decision
+	StatusAbandoned Status = "abandoned" // every waiting client went away before a decision
+)
+
+// Request is the persisted record of a single unlock request.
+type Request struct {
+	ID          string    `json:"id"`
+	VolumeID    string    `json:"volume_id"`          // for batch requests, the volumes joined by commas
+	Volumes     []string  `json:"volumes,omitempty"`  // volumes of a batch request
+	Excluded    []string  `json:"excluded,omitempty"` // batch volumes deselected by approvers
+	Version     int       `json:"version,omitempty"`  // pinned secret version; 0 means latest
+	APIKey      string    `json:"api_key"`            // name of the API key entry, never the key itself
+	ClientIP    string    `json:"client_ip"`
+	Description string    `json:"description"` // summary shown to approvers
+	Status      Status    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	DecidedAt   time.Time `json:"decided_at"`
+	// TwoPhase marks requests created through the two-phase API, whose key is
+	// handed out only once; DeliveredAt is when that happened.
+	TwoPhase    bool      `json:"two_phase,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitzero"`
+	// Timeout is how long the request may stay pending; the service default if zero.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Grant   string        `json:"grant,omitempty"` // ID of the grant that pre-approved the request
+
+	Policy    Policy  `json:"policy"`
+	Votes     []Vote  `json:"votes,omitempty"`
+	DecidedBy []Voter `json:"decided_by,omitempty"` // voters whose votes produced the decision
+
+	// Telegram message carrying the approval buttons, if one was sent.
+	ChatID    int64 `json:"chat_id,omitempty"`
+	MessageID int   `json:"message_id,omitempty"`
+}
+
+type pendingRequest struct {
+	req     Request
+	waiters []chan bool   // one per NewRequest or Coalesce caller
+	done    chan struct{} // closed once the request is decided
+	timer   *time.Timer
+}
+
 type Service struct {
 	mu              sync.RWMutex
-	pendingRequests map[string]chan bool
+	pendingRequests map[string]*pendingRequest
+	grants          map[string]Grant
+	store           Store
+	auditLog        *audit.Logger
+	metrics         *metrics.Metrics
+	timeout         time.Duration
+	onExpire        func(Request)
+	lastPrune       time.Time
+}
+
+type Option func(*Service)
+
+// WithAuditLog records decisions and votes in the audit log.
+func WithAuditLog(l *audit.Logger) Option {
+	return func(s *Service) {
+		s.auditLog = l
+	}
 }
 
-func New() *Service {
-	return &Service{
-		pendingRequests: make(map[string]chan bool),
+// WithMetrics counts decisions and tracks the number of pending requests.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *Service) {
+		s.metrics = m
 	}
 }
 
+// WithDefaultTimeout sets how long requests without their own timeout stay pending.
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		if d > 0 {
+			s.timeout = d
+		}
+	}
+}
+
+// WithStore persists requests in the given store instead of memory only.
+func WithStore(store Store) Option {
+	return func(s *Service) {
+		s.store = store
+	}
+}
+
+func New(opts ...Option) *Service {
+	s := &Service{
+		pendingRequests: make(map[string]*pendingRequest),
+		grants:          make(map[string]Grant),
+		store:           NewMemoryStore(),
+		timeout:         DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
 // NewRequest creates a new approval request, returns its ID and a channel to wait on.
-func (s *Service) NewRequest() (string, <-chan bool) {
-	id := uuid.New().String()
-	ch := make(chan bool, 1) // Buffered to prevent blocking if sender is fast/receiver slow (though usually 1-1)
+// The ID, status and timestamps of info are filled in by the service. A
+// request covered by a grant is approved right away; its Grant field is set.
+func (s *Service) NewRequest(info Request) (string, <-chan bool) {
+	s.mu.Lock()
+	id, ch, granted := s.createLocked(info)
+	s.mu.Unlock()
 
+	s.announce(id, granted)
+	return id, ch
+}
+
+// Coalesce joins a pending request from the same API key and client IP for
+// the same volume and version, created through the same API, so that retries
+// share one request and every waiter receives the outcome. Without such a request it behaves like
+// NewRequest. joined reports whether an existing request was reused.
+func (s *Service) Coalesce(info Request) (id string, ch <-chan bool, joined bool) {
 	s.mu.Lock()
-	s.pendingRequests[id] = ch
+	for _, p := range s.pendingRequests {
+		if p.req.APIKey == info.APIKey && p.req.ClientIP == info.ClientIP &&
+			p.req.VolumeID == info.VolumeID && p.req.Version == info.Version && p.req.TwoPhase == info.TwoPhase {
+			ch := p.addWaiter()
+			s.mu.Unlock()
+			log.Printf("Joined pending approval request: %s", p.req.ID)
+			return p.req.ID, ch, true
+		}
+	}
+	id, ch, granted := s.createLocked(info)
 	s.mu.Unlock()
 
+	s.announce(id, granted)
+	return id, ch, false
+}
+
+// createLocked fills in and tracks a new request. If a grant covers it, the
+// request is decided at once and returned for announce to notify. Callers
+// must hold s.mu.
+func (s *Service) createLocked(info Request) (string, <-chan bool, *pendingRequest) {
+	now := time.Now()
+	info.ID = uuid.New().String()
+	info.Status = StatusPending
+	if info.Policy.RequiredApprovals == 0 && len(info.Policy.Approvers) == 0 {
+		info.Policy = DefaultPolicy
+	}
+	if info.Timeout <= 0 {
+		info.Timeout = s.timeout
+	}
+	info.CreatedAt = now
+	info.ExpiresAt = now.Add(info.Timeout)
+
+	p := s.track(info)
+	ch := p.addWaiter()
+	s.persist(info)
+	g, granted := s.grantFor(info)
+	if !granted {
+		return info.ID, ch, nil
+	}
+	p.req.Grant = g.ID
+	p.req.DecidedBy = []Voter{g.CreatedBy}
+	s.decideLocked(p, StatusApproved)
+	return info.ID, ch, p
+}
+
+// announce logs a new request and wakes up the waiters of one that a grant
+// approved on creation.
+func (s *Service) announce(id string, granted *pendingRequest) {
 	log.Printf("Created new approval request: %s", id)
-	return id, ch
+	if granted != nil {
+		granted.notify()
+		log.Printf("Request %s pre-approved by grant %s", id, granted.req.Grant)
+	}
+}
+
+// track registers a pending request and arms its expiry timer. Callers must hold s.mu.
+func (s *Service) track(req Request) *pendingRequest {
+	p := &pendingRequest{req: req, done: make(chan struct{})}
+	p.timer = time.AfterFunc(time.Until(req.ExpiresAt), func() {
+		if !s.finish(req.ID, StatusExpired) {
+			return
+		}
+		log.Printf("Approval request %s expired", req.ID)
+
+		s.mu.RLock()
+		onExpire := s.onExpire
+		s.mu.RUnlock()
+		if expired, found := s.Get(req.ID); found && onExpire != nil {
+			onExpire(expired)
+		}
+	})
+	s.pendingRequests[req.ID] = p
+	s.metrics.SetPending(len(s.pendingRequests))
+	return p
+}
+
+// addWaiter returns a channel that receives the outcome of the request.
+// Callers must hold s.mu.
+func (p *pendingRequest) addWaiter() chan bool {
+	ch := make(chan bool, 1) // buffered so notify never blocks on a waiter that gave up
+	p.waiters = append(p.waiters, ch)
+	return ch
+}
+
+// OnExpire registers fn to be called with each request whose deadline passes
+// without a decision, or that its clients abandoned, e.g. to update its
+// Telegram message.
+func (s *Service) OnExpire(fn func(Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExpire = fn
+}
+
+// Abandon withdraws the waiter ch from a pending request, e.g. because its
+// client disconnected. Once no waiter is left the request is abandoned, so
+// approvers are not asked about an unlock nobody is waiting for.
+func (s *Service) Abandon(reqID string, ch <-chan bool) {
+	s.mu.Lock()
+	p, exists := s.pendingRequests[reqID]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	p.waiters = slices.DeleteFunc(p.waiters, func(w chan bool) bool { return w == ch })
+	if len(p.waiters) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.decideLocked(p, StatusAbandoned)
+	onExpire := s.onExpire
+	s.mu.Unlock()
+
+	p.notify()
+	log.Printf("Approval request %s abandoned by its clients", reqID)
+	if onExpire != nil {
+		onExpire(p.req)
+	}
 }
 
 // ResolveRequest resolves a pending request with the given approval status.
 // It returns true if the request was found and resolved, false otherwise.
 func (s *Service) ResolveRequest(reqID string, approved bool) bool {
+	status := StatusDenied
+	if approved {
+		status = StatusApproved
+	}
+	if !s.finish(reqID, status) {
+		log.Printf("Attempted to resolve unknown request: %s", reqID)
+		return false
+	}
+	log.Printf("Resolved request %s with status: %v", reqID, approved)
+	return true
+}
+
+// Cancel resolves a pending request as cancelled, e.g. because it could not
+// be sent to the approvers, so its waiters are not told it was denied. It
+// returns false if the request is not pending.
+func (s *Service) Cancel(reqID string) bool {
+	if !s.finish(reqID, StatusCancelled) {
+		return false
+	}
+	log.Printf("Cancelled request %s", reqID)
+	return true
+}
+
+func (s *Service) finish(reqID string, status Status) bool {
+	s.mu.Lock()
+	p, exists := s.pendingRequests[reqID]
+	if !exists {
+		s.mu.Unlock()
+		return false
+	}
+	s.decideLocked(p, status)
+	s.mu.Unlock()
+
+	p.notify()
+	return true
+}
+
+// decideLocked moves a pending request to its final status. Callers must hold
+// s.mu and call p.notify once they have released it.
+func (s *Service) decideLocked(p *pendingRequest, status Status) {
+	delete(s.pendingRequests, p.req.ID)
+	p.timer.Stop()
+	p.req.Status = status
+	p.req.DecidedAt = time.Now()
+	s.metrics.SetPending(len(s.pendingRequests))
+	s.metrics.RequestDecided(p.req.APIKey, string(status), p.req.DecidedAt.Sub(p.req.CreatedAt))
+	if status == StatusApproved || status == StatusDenied {
+		for _, v := range p.req.Votes {
+			if v.Approve == (status == StatusApproved) {
+				p.req.DecidedBy = append(p.req.DecidedBy, v.Voter)
+			}
+		}
+	}
+	s.persist(p.req)
+	s.pruneLocked(p.req.DecidedAt)
+	s.auditLog.Record(audit.Event{
+		Type:      audit.EventRequestDecided,
+		RequestID: p.req.ID,
+		APIKey:    p.req.APIKey,
+		VolumeID:  p.req.VolumeID,
+		ClientIP:  p.req.ClientIP,
+		Actor:     p.req.DeciderNames(),
+		Outcome:   string(status),
+		Detail:    grantDetail(p.req.Grant),
+	})
+}
+
+func grantDetail(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "grant " + id
+}
+
+// CancelAll resolves every pending request as cancelled, waking up their
+// waiters, and returns the cancelled requests. It is used on shutdown.
+func (s *Service) CancelAll() []Request {
+	reqs := s.decideAll(StatusCancelled, nil)
+	if len(reqs) > 0 {
+		log.Printf("Cancelled %d pending approval requests", len(reqs))
+	}
+	return reqs
+}
+
+// Suspend wakes up the waiters of every pending request without deciding
+// it, and returns the suspended requests. It is used on shutdown with a
+// persistent store: the requests stay pending there, so Restore picks them
+// up again after a restart.
+func (s *Service) Suspend() []Request {
+	s.mu.Lock()
+	suspended := make([]*pendingRequest, 0, len(s.pendingRequests))
+	for id, p := range s.pendingRequests {
+		p.timer.Stop()
+		delete(s.pendingRequests, id)
+		suspended = append(suspended, p)
+	}
+	s.metrics.SetPending(0)
+	s.mu.Unlock()
+
+	reqs := make([]Request, 0, len(suspended))
+	for _, p := range suspended {
+		p.notify()
+		reqs = append(reqs, p.req)
+	}
+	if len(reqs) > 0 {
+		log.Printf("Suspended %d pending approval requests until the next start", len(reqs))
+	}
+	return reqs
+}
+
+// DenyAll denies every pending request on behalf of an operator, regardless
+// of the requests' approval policies, and returns the denied requests.
+func (s *Service) DenyAll(by Voter) []Request {
+	reqs := s.decideAll(StatusDenied, &by)
+	if len(reqs) > 0 {
+		log.Printf("Denied %d pending approval requests by %s", len(reqs), by.Name)
+	}
+	return reqs
+}
+
+// decideAll moves every pending request to status, crediting by if set.
+func (s *Service) decideAll(status Status, by *Voter) []Request {
+	s.mu.Lock()
+	decided := make([]*pendingRequest, 0, len(s.pendingRequests))
+	for _, p := range s.pendingRequests {
+		if by != nil {
+			p.req.DecidedBy = append(p.req.DecidedBy, *by)
+		}
+		s.decideLocked(p, status)
+		decided = append(decided, p)
+	}
+	s.mu.Unlock()
+
+	reqs := make([]Request, 0, len(decided))
+	for _, p := range decided {
+		p.notify()
+		reqs = append(reqs, p.req)
+	}
+	return reqs
+}
+
+// Pending returns the requests awaiting a decision, oldest first.
+func (s *Service) Pending() []Request {
+	s.mu.RLock()
+	reqs := make([]Request, 0, len(s.pendingRequests))
+	for _, p := range s.pendingRequests {
+		reqs = append(reqs, p.req)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].CreatedAt.Before(reqs[j].CreatedAt) })
+	return reqs
+}
+
+// History returns up to n decided requests, most recent decision first.
+func (s *Service) History(n int) ([]Request, error) {
+	all, err := s.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored requests: %w", err)
+	}
+
+	decided := make([]Request, 0, len(all))
+	for _, req := range all {
+		if req.Status != StatusPending {
+			decided = append(decided, req)
+		}
+	}
+	sort.Slice(decided, func(i, j int) bool { return decided[i].DecidedAt.After(decided[j].DecidedAt) })
+	if len(decided) > n {
+		decided = decided[:n]
+	}
+	return decided, nil
+}
+
+// notify wakes up everyone waiting on a decided request.
+func (p *pendingRequest) notify() {
+	// The channels are buffered and only ever written once, so this never blocks.
+	for _, ch := range p.waiters {
+		ch <- p.req.Status == StatusApproved
+		close(ch)
+	}
+	close(p.done)
+}
+
+// Wait blocks until the request is decided or ctx is done, and returns the
+// latest state of the request. Any number of callers may wait on the same request.
+func (s *Service) Wait(ctx context.Context, reqID string) (Request, bool) {
+	s.mu.RLock()
+	p, exists := s.pendingRequests[reqID]
+	s.mu.RUnlock()
+
+	if exists {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+	}
+	return s.Get(reqID)
+}
+
+// AttachMessage records the Telegram message that carries the buttons for a request.
+func (s *Service) AttachMessage(reqID string, chatID int64, messageID int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ch, exists := s.pendingRequests[reqID]
-	if !exists {
-		log.Printf("Attempted to resolve unknown request: %s", reqID)
+	if p, exists := s.pendingRequests[reqID]; exists {
+		p.req.ChatID = chatID
+		p.req.MessageID = messageID
+		s.persist(p.req)
+	}
+}
+
+// ClaimDelivery marks an approved request's key as handed out. It reports
+// false if the request is not approved or its key was already claimed, so
+// the key of a request is delivered at most once.
+func (s *Service) ClaimDelivery(reqID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, found, err := s.store.Get(reqID)
+	if err != nil || !found || req.Status != StatusApproved || !req.DeliveredAt.IsZero() {
 		return false
 	}
+	req.DeliveredAt = time.Now()
+	s.persist(req)
+	return true
+}
+
+// ReleaseDelivery undoes ClaimDelivery when the key could not be handed out
+// after all, so the client may try again.
+func (s *Service) ReleaseDelivery(reqID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Non-blocking send in case the receiver has already given up (timeout), 
-	// though for this use case blocking for a bit is usually fine.
+	if req, found, err := s.store.Get(reqID); err == nil && found && !req.DeliveredAt.IsZero() {
+		req.DeliveredAt = time.Time{}
+		s.persist(req)
+	}
+}
+
+// Ping checks that the service is not wedged: its lock can be taken and the
+// store answers a read before ctx is done.
+func (s *Service) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		s.mu.RLock()
+		s.mu.RUnlock()
+		_, _, err := s.store.Get("")
+		done <- err
+	}()
 	select {
-	case ch <- approved:
-		log.Printf("Resolved request %s with status: %v", reqID, approved)
-	case <-time.After(1 * time.Second):
-		log.Printf("Timeout sending to request channel %s", reqID)
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("approval service did not respond: %w", ctx.Err())
 	}
+}
 
-	close(ch)
-	delete(s.pendingRequests, reqID)
-	return true
+// Get returns the current state of a request, pending or decided.
+func (s *Service) Get(reqID string) (Request, bool) {
+	s.mu.RLock()
+	p, exists := s.pendingRequests[reqID]
+	var req Request
+	if exists {
+		req = p.req
+	}
+	s.mu.RUnlock()
+	if exists {
+		return req, true
+	}
+
+	req, found, err := s.store.Get(reqID)
+	if err != nil {
+		log.Printf("Failed to load request %s: %v", reqID, err)
+		return Request{}, false
+	}
+	return req, found
+}
+
+// Restore loads requests persisted by a previous run. Requests that are still
+// within their deadline become pending again so they can be decided; those
+// that expired while the server was down are decided as expired and returned
+// so their Telegram messages can be updated.
+func (s *Service) Restore() ([]Request, error) {
+	reqs, err := s.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored requests: %w", err)
+	}
+
+	now := time.Now()
+	grants, err := s.store.ListGrants()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored grants: %w", err)
+	}
+	s.mu.Lock()
+	for _, g := range grants {
+		s.grants[g.ID] = g
+	}
+	s.pruneGrantsLocked(now)
+	s.pruneLocked(now)
+	s.mu.Unlock()
+
+	var stale []Request
+	for _, req := range reqs {
+		if req.Status != StatusPending {
+			continue
+		}
+
+		if now.Before(req.ExpiresAt) {
+			s.mu.Lock()
+			s.track(req)
+			s.mu.Unlock()
+			log.Printf("Restored pending request %s", req.ID)
+			continue
+		}
+
+		// Expire it the way its timer would have, so the decision is audited
+		// and counted like any other.
+		s.mu.Lock()
+		p := s.track(req)
+		s.decideLocked(p, StatusExpired)
+		s.mu.Unlock()
+		p.notify()
+		log.Printf("Approval request %s expired while the server was down", req.ID)
+		stale = append(stale, p.req)
+	}
+
+	return stale, nil
+}
+
+// pruneLocked deletes decided requests older than retention from the store,
+// at most once per pruneInterval. Callers must hold s.mu.
+func (s *Service) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < pruneInterval {
+		return
+	}
+	s.lastPrune = now
+
+	reqs, err := s.store.List()
+	if err != nil {
+		log.Printf("Failed to list requests for pruning: %v", err)
+		return
+	}
+	for _, req := range reqs {
+		if req.Status != StatusPending && now.Sub(req.DecidedAt) > retention {
+			if err := s.store.Delete(req.ID); err != nil {
+				log.Printf("Failed to prune request %s: %v", req.ID, err)
+			}
+		}
+	}
+}
+
+// persist writes req to the store. Callers that mutate tracked requests must
+// hold s.mu so that writes for the same request are not reordered.
+func (s *Service) persist(req Request) {
+	if err := s.store.Put(req); err != nil {
+		log.Printf("Failed to persist request %s: %v", req.ID, err)
+	}
 }
@@ -1,6 +1,7 @@
 package approval
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -10,7 +11,7 @@ func TestService_Flow(t *testing.T) {
 	svc := New()
 
 	// 1. Create a Request
-	reqID, ch := svc.NewRequest()
+	reqID, ch := svc.NewRequest(Request{VolumeID: "vol"})
 	if reqID == "" {
 		t.Fatal("Expected valid reqID, got empty")
 	}
@@ -61,7 +62,7 @@ func TestService_Concurrency(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			id, ch := svc.NewRequest()
+			id, ch := svc.NewRequest(Request{VolumeID: "vol"})
 
 			// Immediately resolve it in another goroutine
 			go svc.ResolveRequest(id, true)
@@ -85,3 +86,139 @@ func TestService_Concurrency(t *testing.T) {
 		t.Errorf("Expected cleaned map, found %d lingering requests", count)
 	}
 }
+
+func TestService_CancelAll(t *testing.T) {
+	svc := New()
+	id1, ch1 := svc.NewRequest(Request{VolumeID: "vol-1"})
+	id2, ch2 := svc.NewRequest(Request{VolumeID: "vol-2"})
+
+	cancelled := svc.CancelAll()
+	if len(cancelled) != 2 {
+		t.Fatalf("Expected 2 cancelled requests, got %d", len(cancelled))
+	}
+	for _, ch := range []<-chan bool{ch1, ch2} {
+		if approved := <-ch; approved {
+			t.Error("Expected cancelled request to report approved=false")
+		}
+	}
+	for _, id := range []string{id1, id2} {
+		if req, _ := svc.Get(id); req.Status != StatusCancelled {
+			t.Errorf("Expected request %s to be cancelled, got %s", id, req.Status)
+		}
+	}
+	if len(svc.CancelAll()) != 0 {
+		t.Error("Expected no pending requests after CancelAll")
+	}
+}
+
+func TestService_DenyAllAndHistory(t *testing.T) {
+	svc := New()
+	first, _ := svc.NewRequest(Request{VolumeID: "vol-1"})
+	time.Sleep(time.Millisecond)
+	second, _ := svc.NewRequest(Request{VolumeID: "vol-2", Policy: Policy{RequiredApprovals: 1, Approvers: []int64{42}}})
+
+	pending := svc.Pending()
+	if len(pending) != 2 || pending[0].ID != first || pending[1].ID != second {
+		t.Fatalf("Expected both requests pending, oldest first, got %+v", pending)
+	}
+
+	// Operators can deny requests they could not vote on.
+	denied := svc.DenyAll(Voter{ID: 1, Name: "alice"})
+	if len(denied) != 2 || len(svc.Pending()) != 0 {
+		t.Fatalf("Expected all requests to be denied, got %d", len(denied))
+	}
+
+	history, err := svc.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Status != StatusDenied || history[0].DeciderNames() != "alice" {
+		t.Errorf("Expected the latest denial by alice, got %+v", history)
+	}
+}
+
+func TestService_Coalesce(t *testing.T) {
+	svc := New()
+	info := Request{VolumeID: "vol", APIKey: "server-01", ClientIP: "10.0.0.1"}
+
+	id1, ch1, joined := svc.Coalesce(info)
+	if joined {
+		t.Fatal("Expected the first request to be created")
+	}
+	id2, ch2, joined := svc.Coalesce(info)
+	if !joined || id2 != id1 {
+		t.Fatalf("Expected the retry to join %s, got %s (joined %v)", id1, id2, joined)
+	}
+
+	other := info
+	other.ClientIP = "10.0.0.2"
+	if id3, _, joined := svc.Coalesce(other); joined || id3 == id1 {
+		t.Error("Expected a request from another client IP to be separate")
+	}
+
+	svc.ResolveRequest(id1, true)
+	for i, ch := range []<-chan bool{ch1, ch2} {
+		if approved := <-ch; !approved {
+			t.Errorf("Expected waiter %d to receive the approval", i+1)
+		}
+	}
+
+	if _, _, joined := svc.Coalesce(info); joined {
+		t.Error("Expected a decided request not to be joined")
+	}
+}
+
+func TestService_CoalesceKeepsTwoPhaseApart(t *testing.T) {
+	svc := New()
+	twoPhase := Request{VolumeID: "vol", APIKey: "server-01", ClientIP: "10.0.0.1", TwoPhase: true}
+
+	id1, _, _ := svc.Coalesce(twoPhase)
+	blocking := twoPhase
+	blocking.TwoPhase = false
+	if id2, _, joined := svc.Coalesce(blocking); joined || id2 == id1 {
+		t.Error("Expected a blocking request not to join a two-phase request")
+	}
+	if id3, _, joined := svc.Coalesce(twoPhase); !joined || id3 != id1 {
+		t.Errorf("Expected a two-phase retry to join %s, got %s (joined %v)", id1, id3, joined)
+	}
+}
+
+func TestService_Abandon(t *testing.T) {
+	svc := New()
+	abandoned := make(chan Request, 1)
+	svc.OnExpire(func(req Request) { abandoned <- req })
+	info := Request{VolumeID: "vol", APIKey: "server-01", ClientIP: "10.0.0.1"}
+
+	id, ch1, _ := svc.Coalesce(info)
+	_, ch2, _ := svc.Coalesce(info)
+
+	svc.Abandon(id, ch1)
+	if req, _ := svc.Get(id); req.Status != StatusPending {
+		t.Fatalf("Expected the request to stay pending while a client waits, got %s", req.Status)
+	}
+
+	svc.Abandon(id, ch2)
+	select {
+	case req := <-abandoned:
+		if req.ID != id || req.Status != StatusAbandoned {
+			t.Errorf("Expected hook for abandoned %s, got %s (%s)", id, req.ID, req.Status)
+		}
+	default:
+		t.Error("Expected the hook to run for the abandoned request")
+	}
+}
+
+func TestService_Ping(t *testing.T) {
+	svc := New()
+	if err := svc.Ping(context.Background()); err != nil {
+		t.Errorf("Expected an idle service to respond, got %v", err)
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := svc.Ping(ctx); err == nil {
+		t.Error("Expected a wedged service to fail the ping")
+	}
+}
@@ -0,0 +1,116 @@
+package approval
+
+import "sync"
+
+// Store persists approval requests and grants so they survive restarts.
+type Store interface {
+	Put(req Request) error
+	Get(id string) (Request, bool, error)
+	List() ([]Request, error)
+	Delete(id string) error
+
+	PutGrant(g Grant) error
+	ListGrants() ([]Grant, error)
+	DeleteGrant(id string) error
+
+	Close() error
+}
+
+// memoryStoreLimit caps the number of requests a MemoryStore keeps.
+const memoryStoreLimit = 1000
+
+// MemoryStore keeps requests in memory only. It is the default store. Once
+// it holds more than its limit, the oldest decided requests are dropped.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	requests map[string]Request
+	grants   map[string]Grant
+	limit    int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		requests: make(map[string]Request),
+		grants:   make(map[string]Grant),
+		limit:    memoryStoreLimit,
+	}
+}
+
+func (m *MemoryStore) Put(req Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[req.ID] = req
+	if len(m.requests) > m.limit {
+		m.evictOldestLocked()
+	}
+	return nil
+}
+
+// evictOldestLocked drops the decided request decided longest ago. Pending
+// requests are never dropped. Callers must hold m.mu.
+func (m *MemoryStore) evictOldestLocked() {
+	var oldest *Request
+	for _, req := range m.requests {
+		if req.Status == StatusPending {
+			continue
+		}
+		if oldest == nil || req.DecidedAt.Before(oldest.DecidedAt) {
+			oldest = &req
+		}
+	}
+	if oldest != nil {
+		delete(m.requests, oldest.ID)
+	}
+}
+
+func (m *MemoryStore) Get(id string) (Request, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	req, ok := m.requests[id]
+	return req, ok, nil
+}
+
+func (m *MemoryStore) List() ([]Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	reqs := make([]Request, 0, len(m.requests))
+	for _, req := range m.requests {
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.requests, id)
+	return nil
+}
+
+func (m *MemoryStore) PutGrant(g Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grants[g.ID] = g
+	return nil
+}
+
+func (m *MemoryStore) ListGrants() ([]Grant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	grants := make([]Grant, 0, len(m.grants))
+	for _, g := range m.grants {
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+func (m *MemoryStore) DeleteGrant(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.grants, id)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,224 @@
+package approval
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zfs-unlocker/internal/audit"
+	"zfs-unlocker/internal/metrics"
+)
+
+func TestBoltStore_RoundTrip(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	defer store.Close()
+
+	req := Request{ID: "req-1", VolumeID: "vol", APIKey: "key", ClientIP: "10.0.0.1", Status: StatusPending}
+	if err := store.Put(req); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, found, err := store.Get("req-1")
+	if err != nil || !found {
+		t.Fatalf("Expected stored request, found=%v err=%v", found, err)
+	}
+	if got.VolumeID != "vol" || got.ClientIP != "10.0.0.1" {
+		t.Errorf("Unexpected request: %+v", got)
+	}
+
+	if err := store.Delete("req-1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	reqs, err := store.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(reqs) != 0 {
+		t.Errorf("Expected empty store, got %d requests", len(reqs))
+	}
+}
+
+func TestService_PersistsDecision(t *testing.T) {
+	store := NewMemoryStore()
+	svc := New(WithStore(store))
+
+	reqID, _ := svc.NewRequest(Request{VolumeID: "vol", APIKey: "key", ClientIP: "10.0.0.1"})
+	svc.AttachMessage(reqID, 42, 7)
+	svc.ResolveRequest(reqID, false)
+
+	req, found, _ := store.Get(reqID)
+	if !found {
+		t.Fatal("Expected request to be persisted")
+	}
+	if req.Status != StatusDenied || req.DecidedAt.IsZero() {
+		t.Errorf("Expected denied request with decision time, got %+v", req)
+	}
+	if req.ChatID != 42 || req.MessageID != 7 {
+		t.Errorf("Expected message reference to be kept, got %+v", req)
+	}
+}
+
+func TestService_Restore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.Put(Request{ID: "live", Status: StatusPending, CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+	store.Put(Request{ID: "stale", APIKey: "server-01", Status: StatusPending, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute), MessageID: 3})
+	store.Put(Request{ID: "old", Status: StatusApproved, DecidedAt: now.Add(-2 * retention)})
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(auditPath)
+	if err != nil {
+		t.Fatalf("audit.Open failed: %v", err)
+	}
+	defer auditLog.Close()
+	m := metrics.New()
+
+	svc := New(WithStore(store), WithAuditLog(auditLog), WithMetrics(m))
+	stale, err := svc.Restore()
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if len(stale) != 1 || stale[0].ID != "stale" || stale[0].Status != StatusExpired {
+		t.Errorf("Expected only 'stale' to be reported as expired, got %+v", stale)
+	}
+	if req, _, _ := store.Get("stale"); req.Status != StatusExpired {
+		t.Errorf("Expected 'stale' to be stored as expired, got %s", req.Status)
+	}
+
+	// Requests that expired while the server was down are audited and counted.
+	data, _ := os.ReadFile(auditPath)
+	if !strings.Contains(string(data), `"request_id":"stale"`) || !strings.Contains(string(data), `"outcome":"expired"`) {
+		t.Errorf("Expected the expiry of 'stale' to be audited, got:\n%s", data)
+	}
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	for _, want := range []string{
+		`zfs_unlocker_requests_total{api_key="server-01",outcome="expired"} 1`,
+		`zfs_unlocker_pending_requests 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in the metrics", want)
+		}
+	}
+
+	if !svc.ResolveRequest("live", true) {
+		t.Error("Expected restored request to be resolvable")
+	}
+
+	if _, found, _ := store.Get("old"); found {
+		t.Error("Expected request past retention to be pruned")
+	}
+}
+
+func TestService_SuspendKeepsRequestsPending(t *testing.T) {
+	store := NewMemoryStore()
+	svc := New(WithStore(store))
+	id, ch := svc.NewRequest(Request{VolumeID: "vol-1"})
+
+	if suspended := svc.Suspend(); len(suspended) != 1 || suspended[0].ID != id {
+		t.Fatalf("Expected request %s to be suspended, got %+v", id, suspended)
+	}
+	if approved := <-ch; approved {
+		t.Error("Expected suspended request to report approved=false")
+	}
+	if req, _ := svc.Get(id); req.Status != StatusPending {
+		t.Errorf("Expected suspended request to stay pending in the store, got %s", req.Status)
+	}
+
+	restarted := New(WithStore(store))
+	if _, err := restarted.Restore(); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if !restarted.ResolveRequest(id, true) {
+		t.Error("Expected suspended request to be restored after a restart")
+	}
+}
+
+func TestService_PrunesOnDecision(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(Request{ID: "old", Status: StatusApproved, DecidedAt: time.Now().Add(-2 * retention)})
+	svc := New(WithStore(store))
+
+	reqID, _ := svc.NewRequest(Request{VolumeID: "vol"})
+	svc.ResolveRequest(reqID, true)
+
+	if _, found, _ := store.Get("old"); found {
+		t.Error("Expected request past retention to be pruned after a decision")
+	}
+	if _, found, _ := store.Get(reqID); !found {
+		t.Error("Expected the new decision to be kept")
+	}
+}
+
+func TestMemoryStore_Limit(t *testing.T) {
+	store := NewMemoryStore()
+	store.limit = 2
+	now := time.Now()
+	store.Put(Request{ID: "pending", Status: StatusPending})
+	store.Put(Request{ID: "older", Status: StatusDenied, DecidedAt: now.Add(-time.Hour)})
+	store.Put(Request{ID: "newer", Status: StatusApproved, DecidedAt: now})
+
+	reqs, _ := store.List()
+	if len(reqs) != 2 {
+		t.Fatalf("Expected the store to stay at its limit, got %d requests", len(reqs))
+	}
+	if _, found, _ := store.Get("older"); found {
+		t.Error("Expected the oldest decided request to be dropped")
+	}
+	if _, found, _ := store.Get("pending"); !found {
+		t.Error("Expected the pending request to be kept")
+	}
+}
+
+func TestService_Expiry(t *testing.T) {
+	svc := New()
+	reqID, ch := svc.NewRequest(Request{VolumeID: "vol"})
+
+	// Pull the deadline in rather than waiting for DefaultTimeout.
+	svc.mu.Lock()
+	svc.pendingRequests[reqID].timer.Reset(10 * time.Millisecond)
+	svc.mu.Unlock()
+
+	select {
+	case approved := <-ch:
+		if approved {
+			t.Fatal("Expected expired request to report false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for expiry")
+	}
+
+	if req, _ := svc.Get(reqID); req.Status != StatusExpired {
+		t.Errorf("Expected status expired, got %s", req.Status)
+	}
+}
+
+func TestService_RequestTimeout(t *testing.T) {
+	svc := New(WithDefaultTimeout(time.Hour))
+	expired := make(chan Request, 1)
+	svc.OnExpire(func(req Request) { expired <- req })
+
+	defaultID, _ := svc.NewRequest(Request{VolumeID: "vol"})
+	if req, _ := svc.Get(defaultID); req.Timeout != time.Hour {
+		t.Errorf("Expected the service default timeout, got %v", req.Timeout)
+	}
+
+	reqID, _ := svc.NewRequest(Request{VolumeID: "vol", Timeout: 10 * time.Millisecond})
+	select {
+	case req := <-expired:
+		if req.ID != reqID || req.Status != StatusExpired {
+			t.Errorf("Expected expiry hook for %s, got %s (%s)", reqID, req.ID, req.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the expiry hook")
+	}
+}
@@ -0,0 +1,128 @@
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"zfs-unlocker/internal/audit"
+)
+
+var (
+	ErrNotPending   = errors.New("request expired or not found")
+	ErrNotApprover  = errors.New("not an allowed approver for this request")
+	ErrAlreadyVoted = errors.New("already voted on this request")
+)
+
+// Policy describes how many votes decide a request.
+type Policy struct {
+	RequiredApprovals int     `json:"required_approvals"`
+	Approvers         []int64 `json:"approvers,omitempty"` // anyone may vote if empty
+	DenyVeto          bool    `json:"deny_veto"`
+}
+
+// DefaultPolicy lets the first vote decide the request.
+var DefaultPolicy = Policy{RequiredApprovals: 1, DenyVeto: true}
+
+// Voter identifies the person casting a vote.
+type Voter struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type Vote struct {
+	Voter   Voter     `json:"voter"`
+	Approve bool      `json:"approve"`
+	At      time.Time `json:"at"`
+}
+
+// Tally counts the approvals and denials cast so far.
+func (r Request) Tally() (approvals, denials int) {
+	for _, v := range r.Votes {
+		if v.Approve {
+			approvals++
+		} else {
+			denials++
+		}
+	}
+	return approvals, denials
+}
+
+// DeciderNames returns a comma separated list of the voters who decided the request.
+func (r Request) DeciderNames() string {
+	names := make([]string, 0, len(r.DecidedBy))
+	for _, v := range r.DecidedBy {
+		names = append(names, v.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// outcome returns the status the votes cast so far lead to.
+func (p Policy) outcome(approvals, denials int) Status {
+	required := max(p.RequiredApprovals, 1)
+	switch {
+	case approvals >= required:
+		return StatusApproved
+	case denials > 0 && p.DenyVeto:
+		return StatusDenied
+	case len(p.Approvers) > 0 && len(p.Approvers)-denials < required:
+		// Not enough approvers left to reach the quorum.
+		return StatusDenied
+	}
+	return StatusPending
+}
+
+// Vote records a vote on a pending request and decides it once its policy is
+// satisfied. It returns the updated request.
+func (s *Service) Vote(reqID string, voter Voter, approve bool) (Request, error) {
+	s.mu.Lock()
+	p, exists := s.pendingRequests[reqID]
+	if !exists {
+		s.mu.Unlock()
+		return Request{}, ErrNotPending
+	}
+
+	policy := p.req.Policy
+	if len(policy.Approvers) > 0 && !slices.Contains(policy.Approvers, voter.ID) {
+		s.mu.Unlock()
+		return p.req, ErrNotApprover
+	}
+	for _, v := range p.req.Votes {
+		if v.Voter.ID == voter.ID {
+			s.mu.Unlock()
+			return p.req, ErrAlreadyVoted
+		}
+	}
+
+	p.req.Votes = append(p.req.Votes, Vote{Voter: voter, Approve: approve, At: time.Now()})
+	vote := "deny"
+	if approve {
+		vote = "approve"
+	}
+	s.auditLog.Record(audit.Event{
+		Type:      audit.EventVote,
+		RequestID: reqID,
+		VolumeID:  p.req.VolumeID,
+		Actor:     fmt.Sprintf("%s (%d)", voter.Name, voter.ID),
+		Outcome:   vote,
+	})
+	status := policy.outcome(p.req.Tally())
+	if status == StatusPending {
+		s.persist(p.req)
+		req := p.req
+		s.mu.Unlock()
+		log.Printf("Recorded vote on request %s by %d (approve: %v)", reqID, voter.ID, approve)
+		return req, nil
+	}
+
+	s.decideLocked(p, status)
+	req := p.req
+	s.mu.Unlock()
+
+	p.notify()
+	log.Printf("Resolved request %s with status %s by %s", reqID, status, req.DeciderNames())
+	return req, nil
+}
@@ -0,0 +1,78 @@
+package approval
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestService_VoteQuorum(t *testing.T) {
+	svc := New()
+	policy := Policy{RequiredApprovals: 2, Approvers: []int64{1, 2, 3}}
+	reqID, ch := svc.NewRequest(Request{VolumeID: "vol", Policy: policy})
+
+	req, err := svc.Vote(reqID, Voter{ID: 1, Name: "alice"}, true)
+	if err != nil || req.Status != StatusPending {
+		t.Fatalf("Expected request to stay pending after first approval, got %s (err %v)", req.Status, err)
+	}
+
+	if _, err := svc.Vote(reqID, Voter{ID: 1, Name: "alice"}, true); !errors.Is(err, ErrAlreadyVoted) {
+		t.Errorf("Expected ErrAlreadyVoted, got %v", err)
+	}
+	if _, err := svc.Vote(reqID, Voter{ID: 9, Name: "mallory"}, true); !errors.Is(err, ErrNotApprover) {
+		t.Errorf("Expected ErrNotApprover, got %v", err)
+	}
+
+	// Without a veto, a single deny only records the vote.
+	req, _ = svc.Vote(reqID, Voter{ID: 2, Name: "bob"}, false)
+	if req.Status != StatusPending {
+		t.Fatalf("Expected request to stay pending after a non-veto deny, got %s", req.Status)
+	}
+
+	req, _ = svc.Vote(reqID, Voter{ID: 3, Name: "carol"}, true)
+	if req.Status != StatusApproved {
+		t.Fatalf("Expected approval once quorum is reached, got %s", req.Status)
+	}
+	if approved := <-ch; !approved {
+		t.Error("Expected waiter to receive approval")
+	}
+	if approvals, denials := req.Tally(); approvals != 2 || denials != 1 {
+		t.Errorf("Unexpected tally %d/%d", approvals, denials)
+	}
+	if names := req.DeciderNames(); names != "alice, carol" {
+		t.Errorf("Expected decision to be attributed to 'alice, carol', got %q", names)
+	}
+}
+
+func TestService_VoteDenyVeto(t *testing.T) {
+	svc := New()
+	reqID, ch := svc.NewRequest(Request{VolumeID: "vol", Policy: Policy{RequiredApprovals: 2, DenyVeto: true}})
+
+	svc.Vote(reqID, Voter{ID: 1}, true)
+	req, _ := svc.Vote(reqID, Voter{ID: 2}, false)
+	if req.Status != StatusDenied {
+		t.Fatalf("Expected veto to deny the request, got %s", req.Status)
+	}
+	if approved := <-ch; approved {
+		t.Error("Expected waiter to receive denial")
+	}
+}
+
+func TestService_VoteQuorumUnreachable(t *testing.T) {
+	svc := New()
+	reqID, _ := svc.NewRequest(Request{VolumeID: "vol", Policy: Policy{RequiredApprovals: 2, Approvers: []int64{1, 2}}})
+
+	req, _ := svc.Vote(reqID, Voter{ID: 1}, false)
+	if req.Status != StatusDenied {
+		t.Errorf("Expected denial once quorum cannot be reached, got %s", req.Status)
+	}
+}
+
+func TestService_VoteDefaultPolicy(t *testing.T) {
+	svc := New()
+	reqID, _ := svc.NewRequest(Request{VolumeID: "vol"})
+
+	req, _ := svc.Vote(reqID, Voter{ID: 1}, false)
+	if req.Status != StatusDenied {
+		t.Errorf("Expected a single deny to decide under the default policy, got %s", req.Status)
+	}
+}
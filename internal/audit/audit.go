@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types recorded in the audit log.
+const (
+	EventAuthFailed      = "auth.failed"
+	EventClientBanned    = "auth.banned"
+	EventRequestCreated  = "request.created"
+	EventRequestJoined   = "request.joined"
+	EventVote            = "request.vote"
+	EventVoteRejected    = "request.vote_rejected"
+	EventVolumeToggled   = "request.volume_toggled"
+	EventRequestDecided  = "request.decided"
+	EventAutoApproved    = "request.auto_approved"
+	EventGrantCreated    = "grant.created"
+	EventGrantRevoked    = "grant.revoked"
+	EventSecretFetched   = "secret.fetched"
+	EventSecretFetchFail = "secret.fetch_failed"
+	EventLogRecovered    = "audit.recovered"
+)
+
+// Event is a single audit record. Records are chained: each one carries the
+// hash of its predecessor, so editing or removing a line breaks the chain.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	RequestID string    `json:"request_id,omitempty"`
+	APIKey    string    `json:"api_key,omitempty"`
+	VolumeID  string    `json:"volume_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Actor     string    `json:"actor,omitempty"`   // who acted, e.g. the Telegram user
+	Outcome   string    `json:"outcome,omitempty"` // e.g. approved, denied, expired
+	Detail    string    `json:"detail,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// computeHash hashes the record with its Hash field cleared.
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Logger appends events to a JSON-lines file. A nil *Logger discards events,
+// so components can record unconditionally.
+type Logger struct {
+	mu       sync.Mutex
+	f        *os.File
+	lastHash string
+}
+
+// Open opens (or creates) the audit log at path and resumes its hash chain.
+// A malformed final line is the remains of a write interrupted by a crash: it
+// is truncated away and the recovery is recorded. A final record that was
+// written whole but lost only its newline is kept and terminated instead.
+// Malformed lines anywhere else are an error.
+func Open(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	var lastHash string
+	var end int64 // offset just past the last complete record
+	var torn int  // length of a torn final line, if any
+	var unterminated bool
+	r := bufio.NewReader(f)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			f.Close()
+			return nil, fmt.Errorf("failed to read audit log: %w", readErr)
+		}
+		if len(line) == 0 {
+			break
+		}
+		var ev Event
+		complete := line[len(line)-1] == '\n'
+		err := json.Unmarshal(line, &ev)
+		if err == nil && !complete && ev.follows(lastHash) {
+			// Only the final line can lack a newline, so this is the last record.
+			unterminated = true
+			lastHash = ev.Hash
+			end += int64(len(line))
+			break
+		}
+		if err != nil || !complete {
+			if _, peekErr := r.Peek(1); peekErr != io.EOF {
+				f.Close()
+				return nil, fmt.Errorf("failed to parse audit log %s: %w", path, err)
+			}
+			torn = len(line)
+			break
+		}
+		lastHash = ev.Hash
+		end += int64(len(line))
+	}
+
+	l := &Logger{f: f, lastHash: lastHash}
+	if unterminated {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to terminate final audit log record: %w", err)
+		}
+		log.Printf("Audit log %s ended without a newline; terminated its final record", path)
+	}
+	if torn > 0 {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate torn audit log record: %w", err)
+		}
+		log.Printf("Audit log %s ended in a torn record; discarded its last %d bytes", path, torn)
+		l.Record(Event{
+			Type:   EventLogRecovered,
+			Detail: fmt.Sprintf("discarded a torn final record of %d bytes", torn),
+		})
+	}
+	return l, nil
+}
+
+// Record appends an event to the log. Failures are logged but never block
+// the unlock flow.
+func (l *Logger) Record(ev Event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Time = ev.Time.UTC()
+	ev.PrevHash = l.lastHash
+
+	hash, err := ev.computeHash()
+	if err != nil {
+		log.Printf("Failed to hash audit event %s: %v", ev.Type, err)
+		return
+	}
+	ev.Hash = hash
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Failed to encode audit event %s: %v", ev.Type, err)
+		return
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit event %s: %v", ev.Type, err)
+		return
+	}
+	if err := l.f.Sync(); err != nil {
+		log.Printf("Failed to sync audit log: %v", err)
+	}
+	l.lastHash = hash
+}
+
+// follows reports whether e is intact and chains onto the record with hash prev.
+func (e Event) follows(prev string) bool {
+	if e.PrevHash != prev {
+		return false
+	}
+	hash, err := e.computeHash()
+	return err == nil && hash == e.Hash
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Verify checks the hash chain of an audit log and returns the number of
+// valid records. The error names the first line that fails verification.
+func Verify(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var prevHash string
+	line := 0
+	for scanner.Scan() {
+		line++
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return line - 1, fmt.Errorf("line %d: invalid record: %w", line, err)
+		}
+		if ev.PrevHash != prevHash {
+			return line - 1, fmt.Errorf("line %d: chain broken, previous hash does not match", line)
+		}
+		hash, err := ev.computeHash()
+		if err != nil {
+			return line - 1, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != ev.Hash {
+			return line - 1, fmt.Errorf("line %d: record hash mismatch, content was modified", line)
+		}
+		prevHash = ev.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return line, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return line, nil
+}
@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger_ChainAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	l.Record(Event{Type: EventRequestCreated, RequestID: "r1", VolumeID: "vol"})
+	l.Record(Event{Type: EventRequestDecided, RequestID: "r1", Outcome: "approved", Actor: "alice"})
+	l.Close()
+
+	// Reopening must continue the existing chain.
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	l.Record(Event{Type: EventSecretFetched, RequestID: "r1"})
+	l.Close()
+
+	data, _ := os.ReadFile(path)
+	n, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected valid chain, got %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 records, got %d", n)
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path)
+	l.Record(Event{Type: EventRequestDecided, RequestID: "r1", Outcome: "denied"})
+	l.Record(Event{Type: EventRequestDecided, RequestID: "r2", Outcome: "denied"})
+	l.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	modified := strings.Replace(string(data), `"outcome":"denied"`, `"outcome":"approved"`, 1)
+	if _, err := Verify(strings.NewReader(modified)); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Expected modification on line 1 to be detected, got %v", err)
+	}
+
+	removed := lines[1] + "\n"
+	if _, err := Verify(strings.NewReader(removed)); err == nil {
+		t.Error("Expected removal of the first record to be detected")
+	}
+}
+
+func TestOpen_RecoversTornFinalLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path)
+	l.Record(Event{Type: EventRequestCreated, RequestID: "r1"})
+	l.Close()
+
+	// Simulate a crash halfway through writing the second record.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"time":"2024-01-01T00:00:00Z","type":"request.dec`)
+	f.Close()
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected a torn final line to be recovered, got %v", err)
+	}
+	l.Record(Event{Type: EventRequestDecided, RequestID: "r1", Outcome: "approved"})
+	l.Close()
+
+	data, _ := os.ReadFile(path)
+	n, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected valid chain after recovery, got %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 records, got %d", n)
+	}
+	if !strings.Contains(string(data), EventLogRecovered) {
+		t.Error("Expected the recovery to be recorded")
+	}
+}
+
+func TestOpen_KeepsUnterminatedFinalRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path)
+	l.Record(Event{Type: EventRequestCreated, RequestID: "r1"})
+	l.Record(Event{Type: EventRequestDecided, RequestID: "r1", Outcome: "approved"})
+	l.Close()
+
+	// Simulate a crash after the record was written but before its newline.
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0600)
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected an unterminated final record to be kept, got %v", err)
+	}
+	l.Record(Event{Type: EventRequestCreated, RequestID: "r2"})
+	l.Close()
+
+	data, _ = os.ReadFile(path)
+	n, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected valid chain, got %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 records, got %d", n)
+	}
+	if strings.Contains(string(data), EventLogRecovered) {
+		t.Error("Expected no record to be discarded")
+	}
+}
+
+func TestOpen_RejectsMalformedEarlierLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path)
+	l.Record(Event{Type: EventRequestCreated, RequestID: "r1"})
+	l.Close()
+
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append([]byte("garbage\n"), data...), 0600)
+
+	if _, err := Open(path); err == nil {
+		t.Error("Expected a malformed line before the last to be an error")
+	}
+}
+
+func TestLogger_NilIsNoop(t *testing.T) {
+	var l *Logger
+	l.Record(Event{Type: EventAuthFailed})
+	if err := l.Close(); err != nil {
+		t.Errorf("Expected nil logger Close to succeed, got %v", err)
+	}
+}
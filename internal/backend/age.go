@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/vault"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+// AgeFile reads secrets from a single age-encrypted YAML document of the form
+//
+//	<path_prefix>:
+//	  <volume_id>:
+//	    key: <base64 key>
+//
+// The file is decrypted on every lookup, so edits take effect without a restart.
+type AgeFile struct {
+	path       string
+	identities []age.Identity
+}
+
+func newAgeFile(cfg *config.Config) (vault.Client, error) {
+	identities, err := loadIdentities(cfg.Backend.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend.Path == "" {
+		return nil, fmt.Errorf("age-file backend requires backend.path")
+	}
+	return &AgeFile{path: cfg.Backend.Path, identities: identities}, nil
+}
+
+func (a *AgeFile) GetSecret(ctx context.Context, keyPrefix, volumeID string) (map[string]interface{}, error) {
+	plaintext, err := decryptFile(a.path, a.identities)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]map[string]map[string]interface{}
+	if err := yaml.Unmarshal(plaintext, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+	}
+
+	secret, ok := doc[keyPrefix][volumeID]
+	if !ok {
+		return nil, fmt.Errorf("secret not found at %s/%s", keyPrefix, volumeID)
+	}
+	return secret, nil
+}
+
+// KeyDir reads secrets from a directory of age-encrypted key files laid out
+// as <path>/<path_prefix>/<volume_id>.age, each holding the raw key bytes.
+type KeyDir struct {
+	dir        string
+	identities []age.Identity
+}
+
+func newKeyDir(cfg *config.Config) (vault.Client, error) {
+	identities, err := loadIdentities(cfg.Backend.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend.Path == "" {
+		return nil, fmt.Errorf("key-dir backend requires backend.path")
+	}
+	return &KeyDir{dir: cfg.Backend.Path, identities: identities}, nil
+}
+
+func (k *KeyDir) GetSecret(ctx context.Context, keyPrefix, volumeID string) (map[string]interface{}, error) {
+	if !vault.ValidSegment(volumeID) {
+		return nil, fmt.Errorf("invalid volume ID %q", volumeID)
+	}
+
+	dir := k.dir
+	if keyPrefix != "" {
+		for _, part := range strings.Split(keyPrefix, "/") {
+			if !vault.ValidSegment(part) {
+				return nil, fmt.Errorf("invalid path prefix %q", keyPrefix)
+			}
+		}
+		dir = filepath.Join(dir, filepath.FromSlash(keyPrefix))
+	}
+
+	raw, err := decryptFile(filepath.Join(dir, volumeID+".age"), k.identities)
+	if err != nil {
+		return nil, err
+	}
+	// Match the Vault convention of a Base64 encoded "key" field.
+	return map[string]interface{}{"key": base64.StdEncoding.EncodeToString(raw)}, nil
+}
+
+func loadIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		return nil, fmt.Errorf("age backends require backend.identity_file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity file: %w", err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identity file: %w", err)
+	}
+	return identities, nil
+}
+
+func decryptFile(path string, identities []age.Identity) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("secret not found at %s", path)
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r, err := age.Decrypt(f, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return io.ReadAll(r)
+}
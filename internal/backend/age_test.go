@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zfs-unlocker/internal/config"
+
+	"filippo.io/age"
+)
+
+// writeEncrypted encrypts data to identity's recipient and writes it to path.
+func writeEncrypted(t *testing.T, path string, identity *age.X25519Identity, data []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, identity.Recipient())
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	w.Write(data)
+	w.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeIdentity(t *testing.T, dir string) (*age.X25519Identity, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identity, path
+}
+
+func TestAgeFile_GetSecret(t *testing.T) {
+	dir := t.TempDir()
+	identity, identityFile := writeIdentity(t, dir)
+	secretsFile := filepath.Join(dir, "secrets.yaml.age")
+	writeEncrypted(t, secretsFile, identity, []byte("server-01:\n  tank:\n    key: aGVsbG8=\n"))
+
+	client, err := New(&config.Config{Backend: config.BackendConfig{Type: "age-file", Path: secretsFile, IdentityFile: identityFile}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	secret, err := client.GetSecret(context.Background(), "server-01", "tank")
+	if err != nil {
+		t.Fatalf("GetSecret failed: %v", err)
+	}
+	if secret["key"] != "aGVsbG8=" {
+		t.Errorf("Unexpected secret: %v", secret)
+	}
+
+	if _, err := client.GetSecret(context.Background(), "server-01", "missing"); err == nil {
+		t.Error("Expected error for missing volume")
+	}
+}
+
+func TestKeyDir_GetSecret(t *testing.T) {
+	dir := t.TempDir()
+	identity, identityFile := writeIdentity(t, dir)
+	keysDir := filepath.Join(dir, "keys")
+	writeEncrypted(t, filepath.Join(keysDir, "server-01", "tank.age"), identity, []byte("hello"))
+
+	client, err := New(&config.Config{Backend: config.BackendConfig{Type: "key-dir", Path: keysDir, IdentityFile: identityFile}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	secret, err := client.GetSecret(context.Background(), "server-01", "tank")
+	if err != nil {
+		t.Fatalf("GetSecret failed: %v", err)
+	}
+	if secret["key"] != "aGVsbG8=" {
+		t.Errorf("Expected Base64 encoded key, got %v", secret["key"])
+	}
+
+	if _, err := client.GetSecret(context.Background(), "server-01", ".."); err == nil {
+		t.Error("Expected traversal attempt to be rejected")
+	}
+}
+
+func TestNew_UnknownBackend(t *testing.T) {
+	if _, err := New(&config.Config{Backend: config.BackendConfig{Type: "nope"}}); err == nil {
+		t.Error("Expected error for unknown backend")
+	}
+}
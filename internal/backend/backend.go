@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/vault"
+)
+
+// Factory builds a secret backend from the configuration.
+type Factory func(cfg *config.Config) (vault.Client, error)
+
+var registry = map[string]Factory{
+	"vault":    newVault,
+	"age-file": newAgeFile,
+	"key-dir":  newKeyDir,
+}
+
+// The built-in backends are accepted by config validation like registered ones.
+func init() {
+	for name := range registry {
+		config.RegisterBackendType(name)
+	}
+}
+
+// Register makes a backend available under name. It panics if the name is taken.
+func Register(name string, f Factory) {
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("secret backend %q registered twice", name))
+	}
+	registry[name] = f
+	config.RegisterBackendType(name)
+}
+
+// Names returns the registered backend names in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the backend selected by backend.type, defaulting to Vault.
+func New(cfg *config.Config) (vault.Client, error) {
+	name := cfg.Backend.Type
+	if name == "" {
+		name = "vault"
+	}
+
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret backend %q (available: %s)", name, strings.Join(Names(), ", "))
+	}
+	return factory(cfg)
+}
+
+func newVault(cfg *config.Config) (vault.Client, error) {
+	return vault.New(cfg.Vault)
+}
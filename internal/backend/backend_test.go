@@ -0,0 +1,20 @@
+package backend
+
+import (
+	"testing"
+
+	"zfs-unlocker/internal/config"
+)
+
+func TestNames_AcceptedByConfig(t *testing.T) {
+	for _, name := range Names() {
+		cfg := &config.Config{
+			Telegram: config.TelegramConfig{ChatID: 123},
+			ApiKeys:  []config.APIKey{{Name: "server-01", Key: "k", PathPrefix: "server-01"}},
+			Backend:  config.BackendConfig{Type: name, Path: "/etc/zfs-unlocker/keys", IdentityFile: "/etc/zfs-unlocker/age.key"},
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Expected backend %q to pass validation, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Package client fetches keys from a zfs-unlocker server and loads them into
+// ZFS. It backs the zfs-unlocker-client binary run at boot.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for Client fields left zero.
+const (
+	DefaultAttempts   = 5
+	DefaultBackoff    = 2 * time.Second
+	DefaultMaxBackoff = time.Minute
+	DefaultTimeout    = 30 * time.Minute // covers the wait for an approval
+)
+
+// maxKeyResponse bounds the size of a key response.
+const maxKeyResponse = 1 << 20
+
+// pollWait is how long each status poll waits for a decision, below the
+// server's 60 second cap.
+const pollWait = 30 * time.Second
+
+// maxPollFailures is how many polls in a row may fail before the client fails
+// over to the next server.
+const maxPollFailures = 3
+
+// Client requests keys from one or more zfs-unlocker servers. Every attempt
+// tries the servers in order; failed rounds are retried with exponential
+// backoff.
+type Client struct {
+	Servers    []string // base URLs, e.g. https://unlocker.example.com
+	APIKey     string
+	HTTP       *http.Client
+	Attempts   int           // rounds over all servers
+	Backoff    time.Duration // wait after the first failed round, doubled after each
+	MaxBackoff time.Duration
+	Timeout    time.Duration // per attempt against a server, including the wait for approval
+}
+
+// Key is the result of a key request for one volume.
+type Key struct {
+	VolumeID string
+	Key      []byte
+	Excluded bool // the approvers left the volume out of a batch
+}
+
+// Error statuses that end a request without retrying.
+var (
+	ErrDenied       = errors.New("request denied")
+	ErrUnauthorized = errors.New("unauthorized: check the API key and client address")
+)
+
+// permanentError stops retries; the server's answer will not change.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// FetchKeys requests the keys of volumeIDs with a single approval. The request
+// is created once per server with POST /v1/requests and then long-polled, so a
+// dropped connection does not prompt the approvers again: retries poll the
+// same request, and servers already holding one are tried first.
+func (c *Client) FetchKeys(ctx context.Context, volumeIDs []string) ([]Key, error) {
+	if len(c.Servers) == 0 {
+		return nil, errors.New("no server configured")
+	}
+
+	kr := &keyRequest{client: c, volumeIDs: volumeIDs, ids: make(map[string]string)}
+	var keys []Key
+	err := c.retry(ctx, kr.servers, func(ctx context.Context, server string) error {
+		var err error
+		keys, err = kr.fetch(ctx, server)
+		return err
+	})
+	return keys, err
+}
+
+// retry calls fn for every server in turn until one succeeds or fails
+// permanently, waiting between rounds. servers gives the order of each round.
+func (c *Client) retry(ctx context.Context, servers func() []string, fn func(ctx context.Context, server string) error) error {
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		for _, server := range servers() {
+			err := c.attempt(ctx, server, fn)
+			if err == nil {
+				return nil
+			}
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				return perm.err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Attempt %d/%d against %s failed: %v", attempt, attempts, server, err)
+			lastErr = err
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, lastErr)
+		}
+
+		wait := backoff
+		var ra *retryAfterError
+		if errors.As(lastErr, &ra) {
+			wait = max(wait, ra.after)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, server string, fn func(ctx context.Context, server string) error) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(ctx, strings.TrimRight(server, "/"))
+}
+
+// errRequestGone means the server no longer knows the request, or has already
+// delivered its keys; a new request is needed.
+var errRequestGone = errors.New("request is gone from the server")
+
+// keyRequest tracks the approval request for one FetchKeys call on every
+// server it was created on, keyed by the server base URL.
+type keyRequest struct {
+	client    *Client
+	volumeIDs []string
+	ids       map[string]string
+}
+
+// requestStatus is the server's view of a request.
+type requestStatus struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"`
+	Key      []byte            `json:"key"`
+	Keys     map[string][]byte `json:"keys"`
+	Excluded []string          `json:"excluded"`
+}
+
+// servers orders the configured servers so that those holding a request come
+// first and keep waiting on it.
+func (r *keyRequest) servers() []string {
+	servers := slices.Clone(r.client.Servers)
+	slices.SortStableFunc(servers, func(a, b string) int {
+		_, hasA := r.ids[strings.TrimRight(a, "/")]
+		_, hasB := r.ids[strings.TrimRight(b, "/")]
+		switch {
+		case hasA == hasB:
+			return 0
+		case hasA:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return servers
+}
+
+// fetch creates the request on server unless it already holds one, and polls
+// it until a decision. Polls that fail are retried a few times before giving
+// the server up for this round; the request is kept for the next one.
+func (r *keyRequest) fetch(ctx context.Context, server string) ([]Key, error) {
+	id, ok := r.ids[server]
+	if !ok {
+		var err error
+		if id, err = r.create(ctx, server); err != nil {
+			return nil, err
+		}
+		r.ids[server] = id
+		log.Printf("Waiting for approval of request %s on %s", id, server)
+	}
+
+	wait := r.client.Backoff
+	if wait <= 0 {
+		wait = DefaultBackoff
+	}
+	failures := 0
+	for {
+		status, err := r.poll(ctx, server, id)
+		if err != nil {
+			if errors.Is(err, errRequestGone) {
+				delete(r.ids, server)
+				return nil, err
+			}
+			var perm *permanentError
+			var ra *retryAfterError
+			failures++
+			if errors.As(err, &perm) || errors.As(err, &ra) || failures >= maxPollFailures || ctx.Err() != nil {
+				return nil, err
+			}
+			log.Printf("Polling request %s on %s failed: %v", id, server, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		failures = 0
+
+		switch status.Status {
+		case "pending":
+			continue
+		case "approved":
+			return r.keys(status)
+		case "denied":
+			return nil, &permanentError{ErrDenied}
+		case "expired":
+			delete(r.ids, server)
+			return nil, errors.New("no decision before the approval timeout")
+		default: // cancelled or abandoned: the server gave up on the request
+			delete(r.ids, server)
+			return nil, fmt.Errorf("request %s was %s", id, status.Status)
+		}
+	}
+}
+
+// create starts the approval request on server and returns its ID.
+func (r *keyRequest) create(ctx context.Context, server string) (string, error) {
+	body := map[string]any{"volumes": r.volumeIDs}
+	if len(r.volumeIDs) == 1 {
+		body = map[string]any{"volume_id": r.volumeIDs[0]}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", &permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server+"/v1/requests", bytes.NewReader(payload))
+	if err != nil {
+		return "", &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	data, _, err := r.client.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	var status requestStatus
+	if err := json.Unmarshal(data, &status); err != nil || status.ID == "" {
+		return "", fmt.Errorf("invalid response: missing request ID (%v)", err)
+	}
+	return status.ID, nil
+}
+
+// poll long-polls the status of request id on server.
+func (r *keyRequest) poll(ctx context.Context, server, id string) (requestStatus, error) {
+	var status requestStatus
+	u := server + "/v1/requests/" + url.PathEscape(id) + "?wait=" + pollWait.String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return status, &permanentError{err}
+	}
+	data, code, err := r.client.do(req)
+	if code == http.StatusNotFound || code == http.StatusGone {
+		return status, errRequestGone
+	}
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("invalid response: %w", err)
+	}
+	return status, nil
+}
+
+// keys returns the keys of an approved request in the order of the volume IDs.
+func (r *keyRequest) keys(status requestStatus) ([]Key, error) {
+	if len(r.volumeIDs) == 1 {
+		if len(status.Key) == 0 {
+			return nil, &permanentError{fmt.Errorf("no key stored for %s", r.volumeIDs[0])}
+		}
+		return []Key{{VolumeID: r.volumeIDs[0], Key: status.Key}}, nil
+	}
+
+	keys := make([]Key, 0, len(r.volumeIDs))
+	for _, id := range r.volumeIDs {
+		key, ok := status.Keys[id]
+		if !ok {
+			keys = append(keys, Key{VolumeID: id, Excluded: true})
+			continue
+		}
+		keys = append(keys, Key{VolumeID: id, Key: key})
+	}
+	return keys, nil
+}
+
+type retryAfterError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// do sends req with the API key and returns the body and status code of a
+// successful response. Denials and authentication errors are permanent,
+// everything else may be retried. The status code is zero if no response
+// arrived.
+func (c *Client) do(req *http.Request) ([]byte, int, error) {
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyResponse))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return body, resp.StatusCode, nil
+	case http.StatusUnauthorized:
+		return nil, resp.StatusCode, &permanentError{ErrUnauthorized}
+	case http.StatusForbidden:
+		if bytes.Contains(body, []byte(`"denied"`)) {
+			return nil, resp.StatusCode, &permanentError{ErrDenied}
+		}
+		return nil, resp.StatusCode, &permanentError{ErrUnauthorized}
+	case http.StatusBadRequest, http.StatusNotFound:
+		return nil, resp.StatusCode, &permanentError{fmt.Errorf("server rejected the request: %s %s", resp.Status, bytes.TrimSpace(body))}
+	case http.StatusTooManyRequests:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return nil, resp.StatusCode, &retryAfterError{time.Duration(secs) * time.Second, fmt.Errorf("rate limited: %s", resp.Status)}
+	case http.StatusGatewayTimeout:
+		return nil, resp.StatusCode, errors.New("no decision before the approval timeout")
+	case http.StatusServiceUnavailable:
+		return nil, resp.StatusCode, errors.New("server unavailable or restarting")
+	default:
+		return nil, resp.StatusCode, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeZFS is a zfs stand-in that stores loaded keys as files in a directory,
+// named after the dataset with slashes replaced by underscores.
+const fakeZFS = `#!/bin/sh
+case "$1" in
+get)
+	f="$FAKE_ZFS_STATE/$(echo "$6" | tr / _).key"
+	if [ -f "$f" ]; then echo available; else echo unavailable; fi ;;
+load-key)
+	cat > "$FAKE_ZFS_STATE/$(echo "$4" | tr / _).key" ;;
+*)
+	echo "unexpected command $1" >&2; exit 1 ;;
+esac
+`
+
+func newFakeZFS(t *testing.T) (ZFS, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake zfs is a shell script")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "zfs")
+	if err := os.WriteFile(path, []byte(fakeZFS), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state")
+	if err := os.Mkdir(state, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_ZFS_STATE", state)
+	return ZFS{Path: path}, state
+}
+
+func loadedKey(t *testing.T, state, dataset string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(state, strings.ReplaceAll(dataset, "/", "_")+".key"))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestUnlock_Batch(t *testing.T) {
+	z, state := newFakeZFS(t)
+	// tank/done is already unlocked and must not be requested again.
+	os.WriteFile(filepath.Join(state, "tank_done.key"), []byte("old"), 0o600)
+
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v1/requests":
+			var body struct{ Volumes []string }
+			json.NewDecoder(r.Body).Decode(&body)
+			requested = body.Volumes
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]any{"id": "r1", "status": "pending"})
+		case "GET /v1/requests/r1":
+			json.NewEncoder(w).Encode(map[string]any{
+				"id":       "r1",
+				"status":   "approved",
+				"keys":     map[string][]byte{"tank-data": []byte("key-1")},
+				"excluded": []string{"backup"},
+			})
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{Servers: []string{srv.URL}, APIKey: "secret"}
+	targets := []Target{
+		{Dataset: "tank/data", VolumeID: "tank-data"},
+		{Dataset: "tank/done", VolumeID: "tank-done"},
+		{Dataset: "backup/data", VolumeID: "backup"},
+	}
+	err := Unlock(context.Background(), c, z, targets)
+	if err == nil || !strings.Contains(err.Error(), "backup/data: not approved") {
+		t.Errorf("Expected the excluded dataset to be reported, got %v", err)
+	}
+	if strings.Join(requested, ",") != "tank-data,backup" {
+		t.Errorf("Expected only locked datasets to be requested, got %v", requested)
+	}
+	if got := loadedKey(t, state, "tank/data"); got != "key-1" {
+		t.Errorf("Expected key-1 to be loaded into tank/data, got %q", got)
+	}
+	if got := loadedKey(t, state, "backup/data"); got != "" {
+		t.Errorf("Expected backup/data to stay locked, got %q", got)
+	}
+}
+
+// fakeRequests serves the two-phase request API for a single volume. Each
+// poll gets the next of answers, the last one repeating; "drop" closes the
+// connection without an answer.
+type fakeRequests struct {
+	creates, polls atomic.Int32
+	answers        []string
+}
+
+func (f *fakeRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		n := f.creates.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"id": fmt.Sprintf("r%d", n), "status": "pending"})
+		return
+	}
+	n := int(f.polls.Add(1))
+	answer := f.answers[min(n, len(f.answers))-1]
+	switch answer {
+	case "drop":
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	case "approved":
+		json.NewEncoder(w).Encode(map[string]any{"status": answer, "key": []byte("raw-key")})
+	default:
+		json.NewEncoder(w).Encode(map[string]any{"status": answer})
+	}
+}
+
+func TestClient_FailoverAndRetry(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	f := &fakeRequests{answers: []string{"drop", "pending", "approved"}}
+	up := httptest.NewServer(f)
+	defer up.Close()
+
+	c := &Client{Servers: []string{down.URL, up.URL}, APIKey: "secret", Backoff: time.Millisecond}
+	keys, err := c.FetchKeys(context.Background(), []string{"tank-data"})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %v", err)
+	}
+	if len(keys) != 1 || string(keys[0].Key) != "raw-key" {
+		t.Errorf("Expected raw-key, got %+v", keys)
+	}
+	if f.creates.Load() != 1 || f.polls.Load() != 3 {
+		t.Errorf("Expected one request polled 3 times, got %d requests and %d polls", f.creates.Load(), f.polls.Load())
+	}
+}
+
+func TestClient_ReturnsToServerHoldingRequest(t *testing.T) {
+	first := &fakeRequests{answers: []string{"drop", "drop", "drop", "approved"}}
+	srv1 := httptest.NewServer(first)
+	defer srv1.Close()
+	second := &fakeRequests{answers: []string{"expired"}}
+	srv2 := httptest.NewServer(second)
+	defer srv2.Close()
+
+	// Round 1 ends with dropped polls of the request on srv1; round 2 must
+	// poll it before asking srv2 again.
+	c := &Client{Servers: []string{srv2.URL, srv1.URL}, APIKey: "secret", Backoff: time.Millisecond}
+	keys, err := c.FetchKeys(context.Background(), []string{"tank-data"})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %v", err)
+	}
+	if len(keys) != 1 || string(keys[0].Key) != "raw-key" {
+		t.Errorf("Expected raw-key, got %+v", keys)
+	}
+	if first.creates.Load() != 1 || second.creates.Load() != 1 {
+		t.Errorf("Expected one request per server, got %d and %d", first.creates.Load(), second.creates.Load())
+	}
+}
+
+func TestClient_DeniedIsNotRetried(t *testing.T) {
+	f := &fakeRequests{answers: []string{"denied"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c := &Client{Servers: []string{srv.URL}, APIKey: "secret", Backoff: time.Millisecond}
+	_, err := c.FetchKeys(context.Background(), []string{"tank-data"})
+	if !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected ErrDenied, got %v", err)
+	}
+	if f.creates.Load() != 1 || f.polls.Load() != 1 {
+		t.Errorf("Expected a single request and poll for a denied request, got %d and %d", f.creates.Load(), f.polls.Load())
+	}
+}
+
+func TestClient_GivesUp(t *testing.T) {
+	f := &fakeRequests{answers: []string{"expired"}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c := &Client{Servers: []string{srv.URL}, APIKey: "secret", Attempts: 3, Backoff: time.Millisecond}
+	if _, err := c.FetchKeys(context.Background(), []string{"tank-data"}); err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("Expected to give up after 3 attempts, got %v", err)
+	}
+	// An expired request is gone; every attempt asks again.
+	if f.creates.Load() != 3 {
+		t.Errorf("Expected a new request per attempt, got %d", f.creates.Load())
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions")
+	}
+	path := filepath.Join(t.TempDir(), "client.key")
+	os.WriteFile(path, []byte("secret\n"), 0o644)
+	if _, err := ReadKeyFile(path); err == nil {
+		t.Error("Expected a world-readable key file to be refused")
+	}
+
+	os.Chmod(path, 0o600)
+	key, err := ReadKeyFile(path)
+	if err != nil || key != "secret" {
+		t.Errorf("Expected key %q, got %q (%v)", "secret", key, err)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want Target
+	}{
+		{"tank/secure", Target{Dataset: "tank/secure", VolumeID: "tank-secure"}},
+		{"tank/secure=vol1", Target{Dataset: "tank/secure", VolumeID: "vol1"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.arg)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseTarget(%q) = %+v, %v; want %+v", tt.arg, got, err, tt.want)
+		}
+	}
+	for _, arg := range []string{"", "=vol1", "tank/secure="} {
+		if _, err := ParseTarget(arg); err == nil {
+			t.Errorf("ParseTarget(%q): expected an error", arg)
+		}
+	}
+}
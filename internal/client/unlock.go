@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Target maps a dataset to the volume ID its key is stored under.
+type Target struct {
+	Dataset  string
+	VolumeID string
+}
+
+// ParseTarget parses "dataset[=volumeID]". Without an explicit volume ID,
+// the dataset name with slashes replaced by dashes is used, e.g.
+// "tank/secure" becomes "tank-secure".
+func ParseTarget(arg string) (Target, error) {
+	dataset, volumeID, found := strings.Cut(arg, "=")
+	if dataset == "" || (found && volumeID == "") {
+		return Target{}, fmt.Errorf("invalid target %q: want dataset[=volume-id]", arg)
+	}
+	if !found {
+		volumeID = strings.ReplaceAll(dataset, "/", "-")
+	}
+	return Target{Dataset: dataset, VolumeID: volumeID}, nil
+}
+
+// ReadKeyFile reads an API key from path, refusing files that other users
+// could read.
+func ReadKeyFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users (mode %04o); chmod 600 it", path, perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// Unlock loads the keys of every target whose key is not loaded yet, asking
+// the server for all of them with one approval. It returns an error if any
+// dataset is left locked.
+func Unlock(ctx context.Context, c *Client, z ZFS, targets []Target) error {
+	var pending []Target
+	for _, t := range targets {
+		loaded, err := z.KeyLoaded(ctx, t.Dataset)
+		if err != nil {
+			return err
+		}
+		if loaded {
+			log.Printf("Key for %s is already loaded", t.Dataset)
+			continue
+		}
+		pending = append(pending, t)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Datasets sharing a key need it only once.
+	var volumeIDs []string
+	seen := map[string]bool{}
+	for _, t := range pending {
+		if !seen[t.VolumeID] {
+			seen[t.VolumeID] = true
+			volumeIDs = append(volumeIDs, t.VolumeID)
+		}
+	}
+	keys, err := c.FetchKeys(ctx, volumeIDs)
+	if err != nil {
+		return err
+	}
+	byVolume := make(map[string]Key, len(keys))
+	for _, k := range keys {
+		byVolume[k.VolumeID] = k
+	}
+
+	var errs []error
+	for _, t := range pending {
+		k := byVolume[t.VolumeID]
+		if k.Excluded || k.Key == nil {
+			errs = append(errs, fmt.Errorf("%s: not approved", t.Dataset))
+			continue
+		}
+		if err := z.LoadKey(ctx, t.Dataset, k.Key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Loaded key for %s", t.Dataset)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ZFS runs the zfs command line tool.
+type ZFS struct {
+	Path string // zfs executable; "zfs" from $PATH if empty
+}
+
+func (z ZFS) command(ctx context.Context, args ...string) *exec.Cmd {
+	path := z.Path
+	if path == "" {
+		path = "zfs"
+	}
+	return exec.CommandContext(ctx, path, args...)
+}
+
+// KeyLoaded reports whether the key of an encrypted dataset is loaded.
+func (z ZFS) KeyLoaded(ctx context.Context, dataset string) (bool, error) {
+	out, err := z.command(ctx, "get", "-H", "-o", "value", "keystatus", dataset).Output()
+	if err != nil {
+		return false, fmt.Errorf("zfs get keystatus %s: %w", dataset, exitDetail(err))
+	}
+	return strings.TrimSpace(string(out)) == "available", nil
+}
+
+// LoadKey loads key into dataset, passing it on stdin so it never shows up
+// in the process list or the keylocation property.
+func (z ZFS) LoadKey(ctx context.Context, dataset string, key []byte) error {
+	cmd := z.command(ctx, "load-key", "-L", "prompt", dataset)
+	cmd.Stdin = bytes.NewReader(key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("zfs load-key %s: %w", dataset, err)
+	}
+	return nil
+}
+
+// exitDetail adds the command's stderr to an exit error.
+func exitDetail(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return err
+}
@@ -1,41 +1,154 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
+	Backend  BackendConfig  `yaml:"backend"`
 	Vault    VaultConfig    `yaml:"vault"`
 	Telegram TelegramConfig `yaml:"telegram"`
 	Server   ServerConfig   `yaml:"server"`
+	Storage  StorageConfig  `yaml:"storage"`
+	Audit    AuditConfig    `yaml:"audit"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
 	ApiKeys  []APIKey       `yaml:"api_keys"`
+
+	AutoApprove []AutoApproveRule `yaml:"auto_approve"`
 }
 
 type ServerConfig struct {
-	ListenAddress string `yaml:"listen_address"`
-	CertFile      string `yaml:"cert_file"`
-	KeyFile       string `yaml:"key_file"`
+	ListenAddress   string          `yaml:"listen_address"`
+	CertFile        string          `yaml:"cert_file"`
+	KeyFile         string          `yaml:"key_file"`
+	ClientCAFile    string          `yaml:"client_ca_file"`   // enables TLS client certificate authentication
+	LegacyPathAuth  bool            `yaml:"legacy_path_auth"` // allow /unlock/:apiKey/:volumeID
+	ApprovalTimeout time.Duration   `yaml:"approval_timeout"` // how long requests stay pending; defaults to 5m
+	RateLimit       RateLimitConfig `yaml:"rate_limit"`
+	TrustedProxies  []string        `yaml:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-For is believed; none if empty
+}
+
+// RateLimitConfig throttles clients and bans addresses that keep failing to
+// authenticate. Zero values select the defaults.
+type RateLimitConfig struct {
+	Disabled    bool          `yaml:"disabled"`
+	PerIP       float64       `yaml:"per_ip"`        // requests per second per client IP; default 1
+	PerIPBurst  int           `yaml:"per_ip_burst"`  // default 10
+	PerKey      float64       `yaml:"per_key"`       // requests per second per API key; default 1
+	PerKeyBurst int           `yaml:"per_key_burst"` // default 10
+	MaxFailures int           `yaml:"max_failures"`  // failed authentications before an IP is banned; default 5
+	BanDuration time.Duration `yaml:"ban_duration"`  // also the window failures are counted in; default 15m
+}
+
+type StorageConfig struct {
+	Path string `yaml:"path"` // bbolt database file; requests are kept in memory if empty
+}
+
+type AuditConfig struct {
+	Path string `yaml:"path"` // JSON-lines audit log; auditing is disabled if empty
+}
+
+type MetricsConfig struct {
+	Enabled       bool   `yaml:"enabled"`        // serve Prometheus metrics at /metrics
+	ListenAddress string `yaml:"listen_address"` // separate plain-HTTP listener; the API listener if empty
 }
 
 type APIKey struct {
-	Key          string   `yaml:"key"`
-	PathPrefix   string   `yaml:"path_prefix"`
-	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+	Name         string                  `yaml:"name"` // shown in logs and records instead of the key
+	Key          string                  `yaml:"key"`
+	KeyHash      string                  `yaml:"key_hash"` // argon2id, bcrypt or sha256 hash instead of the plaintext key
+	KeyID        string                  `yaml:"key_id"`   // ID prefix of the key, so only this hash is checked for it
+	ClientCert   ClientCertMatch         `yaml:"client_cert"`
+	PathPrefix   string                  `yaml:"path_prefix"`
+	AllowedCIDRs []string                `yaml:"allowed_cidrs"`
+	Approval     ApprovalPolicy          `yaml:"approval"`
+	Volumes      map[string]VolumeConfig `yaml:"volumes"`          // per-volume settings, keyed by volume ID
+	Timeout      time.Duration           `yaml:"approval_timeout"` // overrides server.approval_timeout
+}
+
+// ClientCertMatch maps a TLS client certificate to an API key entry.
+// Every non-empty field must match the presented certificate.
+type ClientCertMatch struct {
+	Subject    string `yaml:"subject"`     // common name or full distinguished name
+	DNSName    string `yaml:"dns_name"`    // DNS subject alternative name
+	SPKISHA256 string `yaml:"spki_sha256"` // hex SHA-256 of the certificate's public key
+}
+
+type VolumeConfig struct {
+	Version   int           `yaml:"version"`          // pin a KV-v2 secret version; 0 means latest
+	Timeout   time.Duration `yaml:"approval_timeout"` // overrides the key's approval_timeout
+	KeyFormat string        `yaml:"keyformat"`        // raw, hex or passphrase; overrides the secret's keyformat field
+}
+
+type ApprovalPolicy struct {
+	RequiredApprovals int     `yaml:"required_approvals"` // defaults to 1
+	Approvers         []int64 `yaml:"approvers"`          // Telegram user IDs; anyone in the chat if empty
+	DenyVeto          *bool   `yaml:"deny_veto"`          // a single deny rejects the request; defaults to true
+}
+
+// AutoApproveRule approves matching requests without a vote. Every set
+// condition must hold; empty conditions match anything.
+type AutoApproveRule struct {
+	Name    string        `yaml:"name"`     // shown in notices and the audit log
+	APIKeys []string      `yaml:"api_keys"` // API key names
+	Volumes []string      `yaml:"volumes"`  // volume ID globs, e.g. "scratch-*"
+	CIDRs   []string      `yaml:"cidrs"`    // client networks
+	Hours   string        `yaml:"hours"`    // daily window in server time, e.g. "08:00-18:00"
+	Max     int           `yaml:"max"`      // auto-approvals per API key and client IP within Per; unlimited if 0
+	Per     time.Duration `yaml:"per"`
+}
+
+// BackendConfig selects where keys are read from.
+type BackendConfig struct {
+	Type         string `yaml:"type"`          // vault (default), age-file or key-dir
+	Path         string `yaml:"path"`          // encrypted secrets file or key directory
+	IdentityFile string `yaml:"identity_file"` // age identities used for decryption
 }
 
 type VaultConfig struct {
-	Address    string `yaml:"address"`
-	Token      string `yaml:"token"`
-	MountPath  string `yaml:"mount_path"`  // e.g. "secret"
-	SecretPath string `yaml:"secret_path"` // e.g. "my-secret"
+	Address    string          `yaml:"address"`
+	Token      string          `yaml:"token"`
+	MountPath  string          `yaml:"mount_path"`  // e.g. "secret"
+	SecretPath string          `yaml:"secret_path"` // e.g. "my-secret"
+	KVVersion  int             `yaml:"kv_version"`  // 1 or 2; defaults to 2
+	Auth       VaultAuthConfig `yaml:"auth"`
+	TLS        VaultTLSConfig  `yaml:"tls"`
+	Transit    TransitConfig   `yaml:"transit"`
+}
+
+// TransitConfig enables storing keys as Transit ciphertext in the KV engine.
+type TransitConfig struct {
+	MountPath string `yaml:"mount_path"` // defaults to "transit"
+	Key       string `yaml:"key"`        // Transit key name; transit mode is off if empty
+}
+
+type VaultAuthConfig struct {
+	Method       string `yaml:"method"`         // token (default), approle, kubernetes or cert
+	MountPath    string `yaml:"mount_path"`     // auth mount; defaults to the method name
+	RoleID       string `yaml:"role_id"`        // approle
+	SecretIDFile string `yaml:"secret_id_file"` // approle
+	Role         string `yaml:"role"`           // kubernetes role, or cert role name
+	JWTFile      string `yaml:"jwt_file"`       // kubernetes; defaults to the pod's service account token
+}
+
+type VaultTLSConfig struct {
+	CACert     string `yaml:"ca_cert"`
+	ClientCert string `yaml:"client_cert"` // required for cert auth
+	ClientKey  string `yaml:"client_key"`
 }
 
 type TelegramConfig struct {
-	BotToken string `yaml:"bot_token"`
-	ChatID   int64  `yaml:"chat_id"`
+	BotToken       string  `yaml:"bot_token"`
+	ChatID         int64   `yaml:"chat_id"`
+	AllowedUserIDs []int64 `yaml:"allowed_user_ids"` // users who may vote; anyone in the chat if empty
+	AdminUserIDs   []int64 `yaml:"admin_user_ids"`   // users who may vote and run operator commands
 }
 
 func Load(path string) (*Config, error) {
@@ -48,10 +161,19 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	// Reject unknown fields so a misspelled option is not silently ignored.
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := cfg.expand(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zfs-unlocker/internal/apikey"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_Valid(t *testing.T) {
+	path := writeConfig(t, `
+telegram:
+  chat_id: 123
+api_keys:
+  - name: server-01
+    key: secret
+    path_prefix: server-01
+    allowed_cidrs: ["192.168.1.10/32"]
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.ApiKeys) != 1 || cfg.ApiKeys[0].Name != "server-01" {
+		t.Errorf("Unexpected API keys: %+v", cfg.ApiKeys)
+	}
+}
+
+func TestLoad_UnknownField(t *testing.T) {
+	path := writeConfig(t, `
+telegram:
+  chat_id: 123
+  chatid: 456
+`)
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "chatid") {
+		t.Errorf("Expected unknown field error, got %v", err)
+	}
+}
+
+func TestValidate_AggregatesErrors(t *testing.T) {
+	slow, err := apikey.Hash(apikey.Bcrypt, "slow-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		ApiKeys: []APIKey{
+			{Name: "a", Key: "k", AllowedCIDRs: []string{"10.0.0.0/8", "not-a-cidr"}},
+			{Name: "a", Key: "k", PathPrefix: "b"},
+			{Name: "c", KeyHash: "md5:abc", PathPrefix: "c"},
+			{Name: "d", Key: "d", PathPrefix: "d", Volumes: map[string]VolumeConfig{"v": {KeyFormat: "base32"}}},
+			{Name: "e", Key: "e", KeyID: "e.1", PathPrefix: "e"},
+			{Name: "f", KeyHash: slow, PathPrefix: "f"},
+		},
+	}
+
+	var verr *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+
+	want := []string{
+		"telegram.chat_id: is required",
+		"api_keys[0].path_prefix: must not be empty",
+		`api_keys[0].allowed_cidrs[1]: invalid CIDR "not-a-cidr"`,
+		`api_keys[1].name: duplicate name "a", also used by api_keys[0]`,
+		"api_keys[1].key: duplicate key, also used by api_keys[0]",
+		"api_keys[2].key_hash: unknown key hash format",
+		`api_keys[3].volumes.v.keyformat: must be raw, hex or passphrase, got "base32"`,
+		"api_keys[4].key_id: requires key_hash",
+		"api_keys[5].key_id: is required for argon2id and bcrypt hashes, so unknown keys cannot trigger slow hash checks; use a sha256 hash for keys without an ID",
+	}
+	if strings.Join(verr.Problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected problems:\n%s\nwant:\n%s", strings.Join(verr.Problems, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoad_Expansion(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(secret, []byte("key-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_BOT_TOKEN", "bot-token")
+	t.Setenv("TEST_PREFIX", "server-01")
+	hash, err := apikey.Hash(apikey.Argon2id, "hashed-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, `
+telegram:
+  bot_token: ${TEST_BOT_TOKEN}
+  chat_id: 123
+api_keys:
+  - key: file://`+secret+`
+    path_prefix: hosts/${TEST_PREFIX}
+  - key_id: abcd
+    key_hash: '`+hash+`'
+    path_prefix: literal-$${TEST_PREFIX}
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Telegram.BotToken != "bot-token" {
+		t.Errorf("Expected bot token from environment, got %q", cfg.Telegram.BotToken)
+	}
+	if cfg.ApiKeys[0].Key != "key-from-file" || cfg.ApiKeys[0].PathPrefix != "hosts/server-01" {
+		t.Errorf("Unexpected first key: %+v", cfg.ApiKeys[0])
+	}
+	if cfg.ApiKeys[1].KeyHash != hash {
+		t.Errorf("Expected key hash to pass through unchanged, got %q", cfg.ApiKeys[1].KeyHash)
+	}
+	if cfg.ApiKeys[1].PathPrefix != "literal-${TEST_PREFIX}" {
+		t.Errorf("Expected escaped reference to stay literal, got %q", cfg.ApiKeys[1].PathPrefix)
+	}
+}
+
+func TestLoad_ExpansionMissing(t *testing.T) {
+	path := writeConfig(t, `
+telegram:
+  chat_id: 123
+api_keys:
+  - key: ${TEST_UNSET_VARIABLE}
+    path_prefix: server-01
+`)
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "api_keys[0].key: environment variable TEST_UNSET_VARIABLE is not set") {
+		t.Errorf("Expected missing variable error, got %v", err)
+	}
+}
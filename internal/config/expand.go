@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envRef matches ${VAR} references; $${VAR} is an escaped, literal ${VAR}.
+// Bare $VAR is left alone so argon2id and bcrypt hashes pass through.
+var envRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand resolves ${VAR} environment references and file:// references in
+// every string field, so secrets can come from the environment, systemd
+// credentials or container secret mounts instead of the config file.
+func (c *Config) expand() error {
+	var problems []string
+	expandValue(reflect.ValueOf(c).Elem(), "", func(path string, err error) {
+		problems = append(problems, path+": "+err.Error())
+	})
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func expandValue(v reflect.Value, path string, fail func(path string, err error)) {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expandString(v.String())
+		if err != nil {
+			fail(path, err)
+			return
+		}
+		v.SetString(s)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			expandValue(v.Elem(), path, fail)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			expandValue(v.Field(i), joinPath(path, name), fail)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fail)
+		}
+	case reflect.Map:
+		// Map values are not addressable; expand a copy and store it back.
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			expandValue(elem, joinPath(path, fmt.Sprint(key.Interface())), fail)
+			v.SetMapIndex(key, elem)
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// expandString resolves a single value. A value starting with file:// is
+// replaced by the file's contents without the trailing newline.
+func expandString(s string) (string, error) {
+	if path, ok := strings.CutPrefix(s, "file://"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read referenced file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	out := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
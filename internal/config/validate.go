@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"zfs-unlocker/internal/apikey"
+)
+
+// backendTypes are the accepted backend.type values. The list is not kept
+// here: package backend registers every backend in its registry, so the two
+// cannot drift apart.
+var backendTypes = map[string]bool{}
+
+// RegisterBackendType makes name an accepted backend.type. Package backend
+// calls it for every backend registered there.
+func RegisterBackendType(name string) {
+	backendTypes[name] = true
+}
+
+// ValidationError lists every problem found in a configuration, each
+// prefixed with the path of the offending field.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate checks the configuration for mistakes that would otherwise only
+// show up at runtime, reporting all of them at once.
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(path, format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Telegram.ChatID == 0 {
+		addf("telegram.chat_id", "is required")
+	}
+
+	if (c.Server.CertFile == "") != (c.Server.KeyFile == "") {
+		addf("server", "cert_file and key_file must be set together")
+	}
+	if c.Server.ClientCAFile != "" && c.Server.CertFile == "" {
+		addf("server.client_ca_file", "requires cert_file and key_file")
+	}
+
+	if c.Server.ApprovalTimeout < 0 {
+		addf("server.approval_timeout", "must not be negative")
+	}
+
+	for i, proxy := range c.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				addf(fmt.Sprintf("server.trusted_proxies[%d]", i), "invalid IP or CIDR %q", proxy)
+			}
+		}
+	}
+
+	rl := c.Server.RateLimit
+	if rl.PerIP < 0 || rl.PerIPBurst < 0 || rl.PerKey < 0 || rl.PerKeyBurst < 0 || rl.MaxFailures < 0 || rl.BanDuration < 0 {
+		addf("server.rate_limit", "limits must not be negative")
+	}
+
+	if c.Metrics.ListenAddress != "" && !c.Metrics.Enabled {
+		addf("metrics.listen_address", "requires metrics.enabled")
+	}
+
+	backendType := c.Backend.Type
+	if backendType == "" {
+		backendType = "vault"
+	}
+	if !backendTypes[backendType] {
+		addf("backend.type", "unknown secret backend %q (available: %s)", backendType, strings.Join(slices.Sorted(maps.Keys(backendTypes)), ", "))
+	}
+	switch backendType {
+	case "age-file", "key-dir":
+		if c.Backend.Path == "" {
+			addf("backend.path", "is required for the %s backend", backendType)
+		}
+		if c.Backend.IdentityFile == "" {
+			addf("backend.identity_file", "is required for the %s backend", backendType)
+		}
+	case "vault":
+		switch c.Vault.Auth.Method {
+		case "approle":
+			if c.Vault.Auth.RoleID == "" {
+				addf("vault.auth.role_id", "is required for approle auth")
+			}
+			if c.Vault.Auth.SecretIDFile == "" {
+				addf("vault.auth.secret_id_file", "is required for approle auth")
+			}
+		case "kubernetes":
+			if c.Vault.Auth.Role == "" {
+				addf("vault.auth.role", "is required for kubernetes auth")
+			}
+		case "cert":
+			if c.Vault.TLS.ClientCert == "" || c.Vault.TLS.ClientKey == "" {
+				addf("vault.tls", "client_cert and client_key are required for cert auth")
+			}
+		}
+	}
+
+	switch c.Vault.KVVersion {
+	case 0, 1, 2:
+	default:
+		addf("vault.kv_version", "must be 1 or 2, got %d", c.Vault.KVVersion)
+	}
+	switch c.Vault.Auth.Method {
+	case "", "token", "approle", "kubernetes", "cert":
+	default:
+		addf("vault.auth.method", "unsupported method %q", c.Vault.Auth.Method)
+	}
+
+	if len(c.ApiKeys) == 0 {
+		addf("api_keys", "no API keys configured")
+	}
+	names := map[string]string{}
+	keys := map[string]string{}
+	keyIDs := map[string]string{}
+	for i, k := range c.ApiKeys {
+		path := fmt.Sprintf("api_keys[%d]", i)
+
+		if k.Name != "" {
+			if prev, ok := names[k.Name]; ok {
+				addf(path+".name", "duplicate name %q, also used by %s", k.Name, prev)
+			}
+			names[k.Name] = path
+		}
+
+		switch {
+		case k.Key != "" && k.KeyHash != "":
+			addf(path, "key and key_hash are mutually exclusive")
+		case k.Key == "" && k.KeyHash == "" && k.ClientCert == (ClientCertMatch{}):
+			addf(path, "one of key, key_hash or client_cert is required")
+		}
+		if k.ClientCert != (ClientCertMatch{}) && c.Server.ClientCAFile == "" {
+			addf(path+".client_cert", "requires server.client_ca_file")
+		}
+		if k.Key != "" {
+			if prev, ok := keys[k.Key]; ok {
+				addf(path+".key", "duplicate key, also used by %s", prev)
+			}
+			keys[k.Key] = path
+		}
+		if k.KeyHash != "" {
+			if err := apikey.CheckFormat(k.KeyHash); err != nil {
+				addf(path+".key_hash", "%v", err)
+			}
+			if prev, ok := keys[k.KeyHash]; ok {
+				addf(path+".key_hash", "duplicate key hash, also used by %s", prev)
+			}
+			keys[k.KeyHash] = path
+		}
+		if k.KeyID == "" && apikey.IsSlow(k.KeyHash) {
+			// Keys without an ID are checked against every entry without one.
+			addf(path+".key_id", "is required for argon2id and bcrypt hashes, so unknown keys cannot trigger slow hash checks; use a sha256 hash for keys without an ID")
+		}
+		if k.KeyID != "" {
+			switch {
+			case k.KeyHash == "":
+				addf(path+".key_id", "requires key_hash")
+			case strings.Contains(k.KeyID, "."):
+				addf(path+".key_id", "must not contain a dot")
+			}
+			if prev, ok := keyIDs[k.KeyID]; ok {
+				addf(path+".key_id", "duplicate key ID %q, also used by %s", k.KeyID, prev)
+			}
+			keyIDs[k.KeyID] = path
+		}
+
+		if strings.Trim(k.PathPrefix, "/ ") == "" {
+			addf(path+".path_prefix", "must not be empty")
+		}
+		for j, cidr := range k.AllowedCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				addf(fmt.Sprintf("%s.allowed_cidrs[%d]", path, j), "invalid CIDR %q", cidr)
+			}
+		}
+
+		if k.Approval.RequiredApprovals < 0 {
+			addf(path+".approval.required_approvals", "must not be negative")
+		}
+		if n := len(k.Approval.Approvers); n > 0 && k.Approval.RequiredApprovals > n {
+			addf(path+".approval.required_approvals", "requires %d approvals but only %d approvers are listed", k.Approval.RequiredApprovals, n)
+		}
+		if k.Timeout < 0 {
+			addf(path+".approval_timeout", "must not be negative")
+		}
+		for volume, v := range k.Volumes {
+			if v.Version < 0 {
+				addf(fmt.Sprintf("%s.volumes.%s.version", path, volume), "must not be negative")
+			}
+			if v.Timeout < 0 {
+				addf(fmt.Sprintf("%s.volumes.%s.approval_timeout", path, volume), "must not be negative")
+			}
+			switch v.KeyFormat {
+			case "", "raw", "hex", "passphrase":
+			default:
+				addf(fmt.Sprintf("%s.volumes.%s.keyformat", path, volume), "must be raw, hex or passphrase, got %q", v.KeyFormat)
+			}
+		}
+	}
+
+	for i, r := range c.AutoApprove {
+		path := fmt.Sprintf("auto_approve[%d]", i)
+		for j, name := range r.APIKeys {
+			if _, ok := names[name]; !ok {
+				addf(fmt.Sprintf("%s.api_keys[%d]", path, j), "no API key named %q", name)
+			}
+		}
+		for j, cidr := range r.CIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				addf(fmt.Sprintf("%s.cidrs[%d]", path, j), "invalid CIDR %q", cidr)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
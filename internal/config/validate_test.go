@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The backend package registers its backends in production.
+func init() {
+	for _, name := range []string{"vault", "age-file", "key-dir"} {
+		RegisterBackendType(name)
+	}
+}
+
+func TestValidate_Prerequisites(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string // expected problem; empty if the config is valid
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"unknown backend", func(c *Config) { c.Backend.Type = "s3" },
+			`backend.type: unknown secret backend "s3" (available: age-file, key-dir, vault)`},
+		{"key-dir without path", func(c *Config) { c.Backend = BackendConfig{Type: "key-dir", IdentityFile: "/etc/zfs-unlocker/age.key"} },
+			"backend.path: is required for the key-dir backend"},
+		{"age-file without identity file", func(c *Config) { c.Backend = BackendConfig{Type: "age-file", Path: "/etc/zfs-unlocker/keys.age"} },
+			"backend.identity_file: is required for the age-file backend"},
+		{"kubernetes without role", func(c *Config) { c.Vault.Auth.Method = "kubernetes" },
+			"vault.auth.role: is required for kubernetes auth"},
+		{"kubernetes", func(c *Config) { c.Vault.Auth = VaultAuthConfig{Method: "kubernetes", Role: "zfs-unlocker"} }, ""},
+		{"approle without role ID", func(c *Config) {
+			c.Vault.Auth = VaultAuthConfig{Method: "approle", SecretIDFile: "/run/secret-id"}
+		}, "vault.auth.role_id: is required for approle auth"},
+		{"approle without secret ID file", func(c *Config) {
+			c.Vault.Auth = VaultAuthConfig{Method: "approle", RoleID: "role"}
+		}, "vault.auth.secret_id_file: is required for approle auth"},
+		{"approle", func(c *Config) {
+			c.Vault.Auth = VaultAuthConfig{Method: "approle", RoleID: "role", SecretIDFile: "/run/secret-id"}
+		}, ""},
+		{"cert auth without client certificate", func(c *Config) { c.Vault.Auth.Method = "cert" },
+			"vault.tls: client_cert and client_key are required for cert auth"},
+		{"cert auth ignored for other backends", func(c *Config) {
+			c.Backend = BackendConfig{Type: "age-file", Path: "/etc/zfs-unlocker/keys.age", IdentityFile: "/etc/zfs-unlocker/age.key"}
+			c.Vault.Auth.Method = "cert"
+		}, ""},
+		{"client certificate without CA", func(c *Config) {
+			c.ApiKeys[0].ClientCert = ClientCertMatch{Subject: "nas-01"}
+		}, "api_keys[0].client_cert: requires server.client_ca_file"},
+		{"client certificate with CA", func(c *Config) {
+			c.Server = ServerConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt"}
+			c.ApiKeys[0].ClientCert = ClientCertMatch{Subject: "nas-01"}
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Telegram: TelegramConfig{ChatID: 123},
+				ApiKeys:  []APIKey{{Name: "server-01", Key: "k", PathPrefix: "server-01"}},
+			}
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Expected a valid config, got %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || strings.Join(verr.Problems, "\n") != tt.want {
+				t.Errorf("Expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
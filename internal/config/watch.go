@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often the config file is checked for changes.
+const DefaultWatchInterval = 5 * time.Second
+
+// Watcher reloads the configuration on SIGHUP or when the file changes on
+// disk. A new configuration is only handed to Apply once it loads cleanly,
+// so a broken edit leaves the running configuration in place.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+
+	// Apply swaps in a new configuration. Returning an error rejects it.
+	Apply func(cfg *Config) error
+	// Report is called with the outcome of every reload attempt.
+	Report func(err error)
+
+	modTime time.Time
+	size    int64
+}
+
+// Run watches until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	w.changed() // record the state of the file the server started with
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading configuration from %s", w.Path)
+			w.changed()
+			w.reload()
+		case <-ticker.C:
+			if w.changed() {
+				log.Printf("Configuration file %s changed, reloading", w.Path)
+				w.reload()
+			}
+		}
+	}
+}
+
+// changed reports whether the file's modification time or size differs from
+// the last check.
+func (w *Watcher) changed() bool {
+	info, err := os.Stat(w.Path)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	return true
+}
+
+func (w *Watcher) reload() {
+	cfg, err := Load(w.Path)
+	if err == nil {
+		err = w.Apply(cfg)
+	}
+	if w.Report != nil {
+		w.Report(err)
+	}
+}
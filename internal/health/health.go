@@ -0,0 +1,162 @@
+// Package health serves liveness and readiness probes for load balancers
+// and service managers.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds each dependency check.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultCacheFor is how long a report is reused before the checks run again.
+const DefaultCacheFor = 5 * time.Second
+
+// Check reports whether a dependency is usable.
+type Check func(ctx context.Context) error
+
+// Checker runs the registered dependency checks.
+type Checker struct {
+	Timeout  time.Duration // per check; DefaultTimeout if zero
+	CacheFor time.Duration // how long a report is reused; DefaultCacheFor if zero
+
+	names  []string
+	checks map[string]Check
+
+	mu       sync.Mutex // held while the checks run, so callers share one run
+	report   Report
+	reportAt time.Time
+}
+
+func New() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+// Add registers a dependency check under name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reportAt = time.Time{}
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Result is the outcome of one dependency check.
+type Result struct {
+	Status string `json:"status"` // ok or error
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Status string            `json:"status"` // ok or unavailable
+	Checks map[string]Result `json:"checks"`
+}
+
+// Run runs every check concurrently and reports whether all of them passed.
+// A report is reused for CacheFor, so frequent probes do not hit the
+// dependencies on every call.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFor := c.CacheFor
+	if cacheFor <= 0 {
+		cacheFor = DefaultCacheFor
+	}
+	if !c.reportAt.IsZero() && time.Since(c.reportAt) < cacheFor {
+		return c.report
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	// Other callers share the result, so a caller going away must not fail it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := Report{Status: "ok", Checks: make(map[string]Result, len(c.names))}
+	for _, name := range c.names {
+		check := c.checks[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := Result{Status: "ok"}
+			if err := check(ctx); err != nil {
+				res = Result{Status: "error", Error: err.Error()}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = res
+			if res.Status != "ok" {
+				report.Status = "unavailable"
+			}
+		}()
+	}
+	wg.Wait()
+	c.report, c.reportAt = report, time.Now()
+	return report
+}
+
+// Healthz answers 200 while the process is serving requests.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz answers 200 if every dependency check passes and 503 otherwise,
+// with the result of each check in the body. Error details are only shown
+// to local callers; others get a generic message.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	if !isLocal(r) {
+		report = redact(report)
+	}
+	writeJSON(w, code, report)
+}
+
+// isLocal reports whether r comes straight from the loopback interface,
+// not through a proxy on the same host.
+func isLocal(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redact returns a copy of report without error details.
+func redact(report Report) Report {
+	checks := make(map[string]Result, len(report.Checks))
+	for name, res := range report.Checks {
+		if res.Error != "" {
+			res.Error = "check failed"
+		}
+		checks[name] = res
+	}
+	return Report{Status: report.Status, Checks: checks}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
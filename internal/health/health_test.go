@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func localRequest() *http.Request {
+	r := httptest.NewRequest("GET", "/readyz", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	return r
+}
+
+func TestChecker_Readyz(t *testing.T) {
+	c := New()
+	c.Add("vault", func(ctx context.Context) error { return nil })
+
+	w := httptest.NewRecorder()
+	c.Readyz(w, localRequest())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with passing checks, got %d", w.Code)
+	}
+
+	c.Add("telegram", func(ctx context.Context) error { return errors.New("unauthorized") })
+	w = httptest.NewRecorder()
+	c.Readyz(w, localRequest())
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 with a failing check, got %d", w.Code)
+	}
+
+	var report Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	want := Report{Status: "unavailable", Checks: map[string]Result{
+		"vault":    {Status: "ok"},
+		"telegram": {Status: "error", Error: "unauthorized"},
+	}}
+	if report.Status != want.Status || len(report.Checks) != 2 ||
+		report.Checks["vault"] != want.Checks["vault"] || report.Checks["telegram"] != want.Checks["telegram"] {
+		t.Errorf("Got report %+v, want %+v", report, want)
+	}
+}
+
+func TestChecker_ReadyzRedactsRemote(t *testing.T) {
+	c := New()
+	c.Add("vault", func(ctx context.Context) error { return errors.New("token lookup failed: permission denied") })
+
+	// A local reverse proxy forwarding a remote caller counts as remote.
+	proxied := localRequest()
+	proxied.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	for _, r := range []*http.Request{httptest.NewRequest("GET", "/readyz", nil), proxied} {
+		w := httptest.NewRecorder()
+		c.Readyz(w, r)
+
+		var report Report
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if w.Code != http.StatusServiceUnavailable || report.Checks["vault"].Error != "check failed" {
+			t.Errorf("Expected a generic error for %s, got %d %s", r.RemoteAddr, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestChecker_Cache(t *testing.T) {
+	var calls atomic.Int32
+	c := New()
+	c.Add("telegram", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+
+	for range 3 {
+		c.Run(context.Background())
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected one check within the cache period, got %d", calls.Load())
+	}
+
+	c.CacheFor = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	c.Run(context.Background())
+	if calls.Load() != 2 {
+		t.Errorf("Expected the check to run again after the cache period, got %d", calls.Load())
+	}
+}
+
+func TestChecker_Timeout(t *testing.T) {
+	c := New()
+	c.Timeout = 10 * time.Millisecond
+	c.Add("vault", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	report := c.Run(context.Background())
+	if report.Checks["vault"].Status != "error" {
+		t.Errorf("Expected a hanging check to fail at the timeout, got %+v", report.Checks["vault"])
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := SdNotify("READY=1"); err != nil {
+		t.Fatalf("SdNotify failed: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1 on the socket, got %q (%v)", buf[:n], err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Errorf("Expected no error without NOTIFY_SOCKET, got %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("Expected 30s, got %v", got)
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("Expected no watchdog for another process, got %v", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Package metrics exposes Prometheus metrics about unlock requests, secret
+// fetches and Telegram delivery.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "zfs_unlocker"
+
+// Metrics holds the collectors on a private registry. A nil *Metrics
+// discards observations, so callers need no checks when metrics are disabled.
+type Metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	decisionTime     *prometheus.HistogramVec
+	fetchTime        *prometheus.HistogramVec
+	pending          prometheus.Gauge
+	telegramFailures prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Unlock requests by API key name and final status.",
+		}, []string{"api_key", "outcome"}),
+		decisionTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "decision_duration_seconds",
+			Help:      "Time from an unlock request to its decision, by final status.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 14400},
+		}, []string{"outcome"}),
+		fetchTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "secret_fetch_duration_seconds",
+			Help:      "Latency of secret fetches from the backend, by result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"result"}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pending_requests",
+			Help:      "Unlock requests awaiting a decision.",
+		}),
+		telegramFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telegram_send_failures_total",
+			Help:      "Telegram API calls that failed.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.decisionTime,
+		m.fetchTime,
+		m.pending,
+		m.telegramFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RequestDecided counts a request reaching its final status after d.
+func (m *Metrics) RequestDecided(apiKey, outcome string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(apiKey, outcome).Inc()
+	m.decisionTime.WithLabelValues(outcome).Observe(d.Seconds())
+}
+
+// SetPending sets the number of requests awaiting a decision.
+func (m *Metrics) SetPending(n int) {
+	if m == nil {
+		return
+	}
+	m.pending.Set(float64(n))
+}
+
+// SecretFetched records how long a backend fetch took and whether it failed.
+func (m *Metrics) SecretFetched(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.fetchTime.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// TelegramSendFailed counts a failed Telegram API call.
+func (m *Metrics) TelegramSendFailed() {
+	if m == nil {
+		return
+	}
+	m.telegramFailures.Inc()
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Exposition(t *testing.T) {
+	m := New()
+	m.RequestDecided("server-01", "approved", 30*time.Second)
+	m.RequestDecided("server-01", "denied", time.Minute)
+	m.SetPending(2)
+	m.SecretFetched(20*time.Millisecond, nil)
+	m.SecretFetched(time.Second, errors.New("sealed"))
+	m.TelegramSendFailed()
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+
+	for _, want := range []string{
+		`zfs_unlocker_requests_total{api_key="server-01",outcome="approved"} 1`,
+		`zfs_unlocker_requests_total{api_key="server-01",outcome="denied"} 1`,
+		`zfs_unlocker_decision_duration_seconds_count{outcome="approved"} 1`,
+		`zfs_unlocker_pending_requests 2`,
+		`zfs_unlocker_secret_fetch_duration_seconds_count{result="error"} 1`,
+		`zfs_unlocker_telegram_send_failures_total 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in the exposition", want)
+		}
+	}
+}
+
+func TestMetrics_NilDiscards(t *testing.T) {
+	var m *Metrics
+	m.RequestDecided("server-01", "approved", time.Second)
+	m.SetPending(1)
+	m.SecretFetched(time.Second, nil)
+	m.TelegramSendFailed()
+}
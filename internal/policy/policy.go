@@ -0,0 +1,224 @@
+// Package policy decides which unlock requests are approved automatically,
+// without waiting for a vote in Telegram.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zfs-unlocker/internal/config"
+)
+
+// Request describes an unlock request for evaluation.
+type Request struct {
+	APIKey   string   // name of the API key entry
+	VolumeID string   // ignored if Volumes is set
+	Volumes  []string // every volume of a batch request; all must match
+	ClientIP string
+}
+
+type rule struct {
+	name    string
+	apiKeys []string
+	volumes []string
+	nets    []*net.IPNet
+	window  *window
+	max     int
+	per     time.Duration
+}
+
+// Engine evaluates auto-approve rules in order. It is safe for concurrent use.
+type Engine struct {
+	mu    sync.Mutex
+	rules []*rule
+	// grants holds the recent auto-approvals per rule and client, for rate limits.
+	grants map[string][]time.Time
+	now    func() time.Time
+}
+
+// New compiles the configured rules.
+func New(rules []config.AutoApproveRule) (*Engine, error) {
+	e := &Engine{grants: make(map[string][]time.Time), now: time.Now}
+	if err := e.Update(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Update replaces the rules, keeping the rate-limit history of rules that
+// keep their name. On error the current rules stay in place.
+func (e *Engine) Update(rules []config.AutoApproveRule) error {
+	rs, err := Compile(rules)
+	if err != nil {
+		return err
+	}
+	e.Swap(rs)
+	return nil
+}
+
+// RuleSet is a compiled list of rules, ready to be swapped into an Engine.
+type RuleSet struct {
+	rules []*rule
+}
+
+// Compile checks and compiles rules without putting them in effect.
+func Compile(rules []config.AutoApproveRule) (*RuleSet, error) {
+	compiled := make([]*rule, 0, len(rules))
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("auto_approve[%d]: %w", i, err)
+		}
+		if c.name == "" {
+			c.name = fmt.Sprintf("rule-%d", i+1)
+		}
+		compiled = append(compiled, c)
+	}
+	return &RuleSet{rules: compiled}, nil
+}
+
+// Swap puts compiled rules in effect, keeping the rate-limit history of
+// rules that keep their name.
+func (e *Engine) Swap(rs *RuleSet) {
+	e.mu.Lock()
+	e.rules = rs.rules
+	e.mu.Unlock()
+}
+
+func compile(r config.AutoApproveRule) (*rule, error) {
+	c := &rule{name: r.Name, apiKeys: r.APIKeys, volumes: r.Volumes, max: r.Max, per: r.Per}
+	for _, glob := range r.Volumes {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid volume glob %q: %w", glob, err)
+		}
+		// Volume IDs are single path segments, so a slash never matches.
+		if strings.Contains(glob, "/") {
+			return nil, fmt.Errorf("invalid volume glob %q: volume IDs cannot contain \"/\" (tank/scratch is requested as tank-scratch)", glob)
+		}
+	}
+	for _, cidr := range r.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		c.nets = append(c.nets, network)
+	}
+	if r.Hours != "" {
+		w, err := parseWindow(r.Hours)
+		if err != nil {
+			return nil, err
+		}
+		c.window = w
+	}
+	if r.Max < 0 || r.Per < 0 {
+		return nil, fmt.Errorf("max and per must not be negative")
+	}
+	if r.Max > 0 && r.Per == 0 {
+		return nil, fmt.Errorf("max requires per")
+	}
+	return c, nil
+}
+
+// Evaluate returns the name of the first rule that auto-approves req. A match
+// counts against the rule's rate limit. A nil Engine approves nothing.
+func (e *Engine) Evaluate(req Request) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	for _, r := range e.rules {
+		if !r.matches(req, now) {
+			continue
+		}
+		if r.max > 0 {
+			key := r.name + "\x00" + req.APIKey + "\x00" + req.ClientIP
+			recent := e.recent(key, now.Add(-r.per))
+			if len(recent) >= r.max {
+				continue
+			}
+			e.grants[key] = append(recent, now)
+		}
+		return r.name, true
+	}
+	return "", false
+}
+
+// recent drops grants older than since and returns the rest. Callers must hold e.mu.
+func (e *Engine) recent(key string, since time.Time) []time.Time {
+	grants := e.grants[key]
+	i := 0
+	for i < len(grants) && !grants[i].After(since) {
+		i++
+	}
+	grants = grants[i:]
+	if len(grants) == 0 {
+		delete(e.grants, key)
+	}
+	return grants
+}
+
+func (r *rule) matches(req Request, now time.Time) bool {
+	if len(r.apiKeys) > 0 && !slices.Contains(r.apiKeys, req.APIKey) {
+		return false
+	}
+	if len(r.volumes) > 0 {
+		volumes := req.Volumes
+		if len(volumes) == 0 {
+			volumes = []string{req.VolumeID}
+		}
+		for _, v := range volumes {
+			if !slices.ContainsFunc(r.volumes, func(glob string) bool {
+				ok, _ := path.Match(glob, v)
+				return ok
+			}) {
+				return false
+			}
+		}
+	}
+	if len(r.nets) > 0 {
+		ip := net.ParseIP(req.ClientIP)
+		if ip == nil || !slices.ContainsFunc(r.nets, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return false
+		}
+	}
+	if r.window != nil && !r.window.contains(now) {
+		return false
+	}
+	return true
+}
+
+// window is a daily time-of-day range in minutes since midnight, local time.
+// A window whose end is before its start wraps around midnight.
+type window struct {
+	start, end int
+}
+
+// parseWindow parses "HH:MM-HH:MM".
+func parseWindow(s string) (*window, error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return nil, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+	}
+	for _, v := range [][2]int{{h1, m1}, {h2, m2}} {
+		if v[0] < 0 || v[0] > 24 || v[1] < 0 || v[1] > 59 || (v[0] == 24 && v[1] != 0) {
+			return nil, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+		}
+	}
+	return &window{start: h1*60 + m1, end: h2*60 + m2}, nil
+}
+
+func (w *window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"zfs-unlocker/internal/config"
+)
+
+func TestEngine_Conditions(t *testing.T) {
+	e, err := New([]config.AutoApproveRule{{
+		Name:    "office",
+		APIKeys: []string{"server-01"},
+		Volumes: []string{"tank-scratch-*"},
+		CIDRs:   []string{"10.0.0.0/8"},
+		Hours:   "22:00-06:00",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.now = func() time.Time { return time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local) }
+
+	match := Request{APIKey: "server-01", VolumeID: "tank-scratch-1", ClientIP: "10.1.2.3"}
+	tests := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"all conditions hold", match, true},
+		{"other key", Request{APIKey: "server-02", VolumeID: match.VolumeID, ClientIP: match.ClientIP}, false},
+		{"volume outside glob", Request{APIKey: match.APIKey, VolumeID: "tank-secure", ClientIP: match.ClientIP}, false},
+		{"address outside CIDR", Request{APIKey: match.APIKey, VolumeID: match.VolumeID, ClientIP: "192.168.1.1"}, false},
+	}
+	for _, tt := range tests {
+		if _, ok := e.Evaluate(tt.req); ok != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, ok)
+		}
+	}
+
+	e.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local) }
+	if _, ok := e.Evaluate(match); ok {
+		t.Error("Expected no auto-approval outside the time window")
+	}
+}
+
+func TestEngine_Rate(t *testing.T) {
+	e, err := New([]config.AutoApproveRule{{Max: 1, Per: 24 * time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.Local)
+	e.now = func() time.Time { return now }
+
+	host := Request{APIKey: "server-01", VolumeID: "vol", ClientIP: "10.0.0.1"}
+	if name, ok := e.Evaluate(host); !ok || name != "rule-1" {
+		t.Fatalf("Expected first request to be auto-approved by rule-1, got %q %v", name, ok)
+	}
+	if _, ok := e.Evaluate(host); ok {
+		t.Error("Expected second request within a day to need approval")
+	}
+	if _, ok := e.Evaluate(Request{APIKey: "server-02", VolumeID: "vol", ClientIP: "10.0.0.2"}); !ok {
+		t.Error("Expected the limit to apply per host")
+	}
+
+	now = now.Add(25 * time.Hour)
+	if _, ok := e.Evaluate(host); !ok {
+		t.Error("Expected auto-approval again after the period")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, r := range []config.AutoApproveRule{
+		{Hours: "8-18"},
+		{Volumes: []string{"["}},
+		{Volumes: []string{"tank/scratch-*"}},
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{Max: 1},
+	} {
+		if _, err := New([]config.AutoApproveRule{r}); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+}
+
+func TestEngine_NilApprovesNothing(t *testing.T) {
+	var e *Engine
+	if _, ok := e.Evaluate(Request{VolumeID: "vol"}); ok {
+		t.Error("Expected nil engine to approve nothing")
+	}
+}
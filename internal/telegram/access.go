@@ -0,0 +1,55 @@
+package telegram
+
+import (
+	"slices"
+
+	"zfs-unlocker/internal/approval"
+	"zfs-unlocker/internal/config"
+)
+
+// access holds the Telegram settings that decide who may vote and run
+// commands. It is replaced as a whole on a config reload.
+type access struct {
+	chatID       int64
+	allowedUsers []int64
+	adminUsers   []int64
+}
+
+func accessFromConfig(cfg config.TelegramConfig) access {
+	return access{chatID: cfg.ChatID, allowedUsers: cfg.AllowedUserIDs, adminUsers: cfg.AdminUserIDs}
+}
+
+// canDecide reports whether a button pressed by userID in chatID may decide
+// req: it must be pressed in the configured chat, or the chat the request was
+// posted to so requests keep working after telegram.chat_id is reloaded, by
+// a user allowed to vote. req is the zero Request if it is unknown.
+func (a access) canDecide(chatID, userID int64, req approval.Request) bool {
+	inChat := chatID == a.chatID || (req.ChatID != 0 && req.ChatID == chatID)
+	return inChat && a.canVote(userID)
+}
+
+// canVote reports whether a Telegram user may vote on requests.
+func (a access) canVote(userID int64) bool {
+	if len(a.allowedUsers) == 0 && len(a.adminUsers) == 0 {
+		return true
+	}
+	return slices.Contains(a.allowedUsers, userID) || slices.Contains(a.adminUsers, userID)
+}
+
+// canOperate reports whether a Telegram user may run operator commands:
+// admins, or anyone allowed to vote when no admins are configured.
+func (a access) canOperate(userID int64) bool {
+	if len(a.adminUsers) == 0 {
+		return a.canVote(userID)
+	}
+	return slices.Contains(a.adminUsers, userID)
+}
+
+// canRun reports whether a Telegram user may run cmd: operator commands need
+// canOperate, the others canVote.
+func (a access) canRun(cmd string, userID int64) bool {
+	if operatorCommands[cmd] {
+		return a.canOperate(userID)
+	}
+	return a.canVote(userID)
+}
@@ -0,0 +1,62 @@
+package telegram
+
+import (
+	"testing"
+
+	"zfs-unlocker/internal/approval"
+)
+
+func TestAccess_CanDecide(t *testing.T) {
+	const (
+		chat     = int64(-100)
+		oldChat  = int64(-200)
+		voter    = int64(1)
+		admin    = int64(2)
+		stranger = int64(3)
+	)
+	restricted := access{chatID: chat, allowedUsers: []int64{voter}, adminUsers: []int64{admin}}
+	open := access{chatID: chat}
+	posted := approval.Request{ID: "r", ChatID: oldChat}
+
+	for _, tt := range []struct {
+		name   string
+		access access
+		chatID int64
+		userID int64
+		req    approval.Request
+		want   bool
+	}{
+		{"allowed user", restricted, chat, voter, approval.Request{}, true},
+		{"admin", restricted, chat, admin, approval.Request{}, true},
+		{"unknown user", restricted, chat, stranger, approval.Request{}, false},
+		{"wrong chat", restricted, -300, voter, approval.Request{}, false},
+		{"wrong chat for an unknown request", restricted, oldChat, voter, approval.Request{}, false},
+		{"chat the request was posted to", restricted, oldChat, voter, posted, true},
+		{"unknown user in the posted chat", restricted, oldChat, stranger, posted, false},
+		{"anyone without an allowlist", open, chat, stranger, approval.Request{}, true},
+		{"wrong chat without an allowlist", open, -300, stranger, approval.Request{}, false},
+	} {
+		if got := tt.access.canDecide(tt.chatID, tt.userID, tt.req); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestAccess_CanOperate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		access access
+		userID int64
+		want   bool
+	}{
+		{"admin", access{allowedUsers: []int64{1}, adminUsers: []int64{2}}, 2, true},
+		{"voter when admins are configured", access{allowedUsers: []int64{1}, adminUsers: []int64{2}}, 1, false},
+		{"voter without admins", access{allowedUsers: []int64{1}}, 1, true},
+		{"unknown user without admins", access{allowedUsers: []int64{1}}, 3, false},
+		{"anyone without any allowlist", access{}, 3, true},
+	} {
+		if got := tt.access.canOperate(tt.userID); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
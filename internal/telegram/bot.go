@@ -1,13 +1,21 @@
 package telegram
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"zfs-unlocker/internal/approval"
+	"zfs-unlocker/internal/audit"
 	"zfs-unlocker/internal/config"
+	"zfs-unlocker/internal/metrics"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -15,10 +23,51 @@ import (
 type Bot struct {
 	api             *tgbotapi.BotAPI
 	approvalService *approval.Service
-	chatID          int64
+	auditLog        *audit.Logger
+	metrics         *metrics.Metrics
+	done            chan struct{} // closed when the update loop exits
+
+	// Reported by /status.
+	version     string
+	started     time.Time
+	healthCheck func() error
+
+	// Settings that can change on a config reload.
+	mu     sync.RWMutex
+	access access
+}
+
+type Option func(*Bot)
+
+// WithAuditLog records rejected callbacks in the audit log.
+func WithAuditLog(l *audit.Logger) Option {
+	return func(b *Bot) {
+		b.auditLog = l
+	}
+}
+
+// WithMetrics counts failed Telegram API calls.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(b *Bot) {
+		b.metrics = m
+	}
+}
+
+// WithVersion sets the version reported by /status.
+func WithVersion(v string) Option {
+	return func(b *Bot) {
+		b.version = v
+	}
+}
+
+// WithHealthCheck reports the secret backend's health in /status.
+func WithHealthCheck(check func() error) Option {
+	return func(b *Bot) {
+		b.healthCheck = check
+	}
 }
 
-func New(cfg config.TelegramConfig, approvalService *approval.Service) (*Bot, error) {
+func New(cfg config.TelegramConfig, approvalService *approval.Service, opts ...Option) (*Bot, error) {
 	token := cfg.BotToken
 	if token == "" {
 		token = os.Getenv("TELEGRAM_BOT_TOKEN")
@@ -33,11 +82,39 @@ func New(cfg config.TelegramConfig, approvalService *approval.Service) (*Bot, er
 
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
-	return &Bot{
+	b := &Bot{
 		api:             bot,
 		approvalService: approvalService,
-		chatID:          cfg.ChatID,
-	}, nil
+		access:          accessFromConfig(cfg),
+		done:            make(chan struct{}),
+		version:         "dev",
+		started:         time.Now(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	approvalService.OnExpire(b.expireMessage)
+	return b, nil
+}
+
+// Reload applies a new Telegram configuration. The bot token cannot be
+// changed without a restart.
+func (b *Bot) Reload(cfg config.TelegramConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.access = accessFromConfig(cfg)
+}
+
+// currentAccess returns the chat and user settings in effect.
+func (b *Bot) currentAccess() access {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.access
+}
+
+// chat returns the chat approval requests are sent to.
+func (b *Bot) chat() int64 {
+	return b.currentAccess().chatID
 }
 
 func (b *Bot) Start() {
@@ -47,72 +124,280 @@ func (b *Bot) Start() {
 	updates := b.api.GetUpdatesChan(u)
 
 	go func() {
+		defer close(b.done)
 		for update := range updates {
 			if update.CallbackQuery != nil {
 				b.handleCallback(update.CallbackQuery)
 				continue
 			}
-			// Handle other messages if needed
+			if update.Message != nil && update.Message.IsCommand() {
+				b.handleCommand(update.Message)
+			}
 		}
 	}()
 }
 
+// Stop stops polling for updates and waits for the update loop to finish,
+// or until ctx is done since a long poll may still be in flight.
+func (b *Bot) Stop(ctx context.Context) {
+	b.api.StopReceivingUpdates()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		log.Printf("Telegram update loop did not stop in time: %v", ctx.Err())
+	}
+}
+
+// Ping checks that the Telegram Bot API is reachable and accepts the token.
+func (b *Bot) Ping(ctx context.Context) error {
+	errc := make(chan error, 1) // buffered so a late answer does not leak the goroutine
+	go func() {
+		_, err := b.api.GetMe()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // RequestApproval sends a message with inline buttons to approve/deny
 func (b *Bot) RequestApproval(reqID string, description string) error {
-	msg := tgbotapi.NewMessage(b.chatID, fmt.Sprintf("🔓 *Unlock Request*\nID: `%s`\nInfo: %s", reqID, description))
+	req, found := b.approvalService.Get(reqID)
+	if !found {
+		req = approval.Request{ID: reqID, Policy: approval.DefaultPolicy}
+	}
+	req.Description = description
+
+	msg := tgbotapi.NewMessage(b.chat(), pendingText(req))
 	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = approvalKeyboard(req)
 
-	approveBtn := tgbotapi.NewInlineKeyboardButtonData("✅ Approve", fmt.Sprintf("approve:%s", reqID))
-	denyBtn := tgbotapi.NewInlineKeyboardButtonData("❌ Deny", fmt.Sprintf("deny:%s", reqID))
+	sent, err := b.send(msg)
+	if err != nil {
+		return err
+	}
+	b.approvalService.AttachMessage(reqID, sent.Chat.ID, sent.MessageID)
+	return nil
+}
 
-	row := tgbotapi.NewInlineKeyboardRow(approveBtn, denyBtn)
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+// send sends a message or edit, counting failures.
+func (b *Bot) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, err := b.api.Send(c)
+	if err != nil {
+		b.metrics.TelegramSendFailed()
+	}
+	return msg, err
+}
 
-	_, err := b.api.Send(msg)
+// Notify sends an informational message to the approval chat.
+func (b *Bot) Notify(text string) error {
+	_, err := b.send(tgbotapi.NewMessage(b.chat(), text))
 	return err
 }
 
-func (b *Bot) handleCallback(cb *tgbotapi.CallbackQuery) {
-	data := cb.Data
-	parts := strings.Split(data, ":")
-	if len(parts) != 2 {
-		return
+// approvalKeyboard returns the voting buttons, preceded by one toggle button
+// per volume for batch requests.
+func approvalKeyboard(req approval.Request) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, v := range req.Volumes {
+		mark := "☑️"
+		if slices.Contains(req.Excluded, v) {
+			mark = "⬜"
+		}
+		toggle := tgbotapi.NewInlineKeyboardButtonData(mark+" "+v, fmt.Sprintf("toggle:%s:%d", req.ID, i))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(toggle))
 	}
 
-	action := parts[0]
-	reqID := parts[1]
-
-	var responseText string
-	var success bool
+	approveBtn := tgbotapi.NewInlineKeyboardButtonData("✅ Approve", fmt.Sprintf("approve:%s", req.ID))
+	denyBtn := tgbotapi.NewInlineKeyboardButtonData("❌ Deny", fmt.Sprintf("deny:%s", req.ID))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(approveBtn, denyBtn))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
 
-	switch action {
-	case "approve":
-		success = b.approvalService.ResolveRequest(reqID, true)
-		if success {
-			responseText = fmt.Sprintf("✅ Request %s Approved", reqID)
+// pendingText renders the approval message, including the live vote tally
+// for requests that need more than one approval.
+func pendingText(req approval.Request) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🔓 *Unlock Request*\nID: `%s`\nInfo: %s", req.ID, req.Description)
+	if !req.ExpiresAt.IsZero() {
+		fmt.Fprintf(&sb, "\nExpires: %s", req.ExpiresAt.Format("15:04:05 MST"))
+	}
+	if len(req.Volumes) > 0 {
+		if len(req.Votes) > 0 {
+			sb.WriteString("\nVolumes (fixed once voting started):")
 		} else {
-			responseText = "⚠️ Request expired or not found"
+			sb.WriteString("\nVolumes (tap to leave one out):")
 		}
-	case "deny":
-		success = b.approvalService.ResolveRequest(reqID, false)
-		if success {
-			responseText = fmt.Sprintf("❌ Request %s Denied", reqID)
-		} else {
-			responseText = "⚠️ Request expired or not found"
+		for _, v := range req.Volumes {
+			mark := "☑️"
+			if slices.Contains(req.Excluded, v) {
+				mark = "⬜"
+			}
+			fmt.Fprintf(&sb, "\n%s `%s`", mark, v)
 		}
 	}
 
-	// Answer callback to stop loading animation
-	callbackCfg := tgbotapi.NewCallback(cb.ID, responseText)
-	if _, err := b.api.Request(callbackCfg); err != nil {
-		log.Printf("Failed to answer callback: %v", err)
+	if req.Policy.RequiredApprovals > 1 || len(req.Votes) > 0 {
+		approvals, denials := req.Tally()
+		fmt.Fprintf(&sb, "\nVotes: %d/%d approvals, %d denials", approvals, req.Policy.RequiredApprovals, denials)
+		for _, v := range req.Votes {
+			mark := "❌"
+			if v.Approve {
+				mark = "✅"
+			}
+			fmt.Fprintf(&sb, "\n%s %s", mark, tgbotapi.EscapeText(tgbotapi.ModeMarkdown, v.Voter.Name))
+		}
+	}
+	return sb.String()
+}
+
+// ReconcileStale updates the messages of requests that expired while the
+// server was down, so their buttons no longer suggest they can be decided.
+func (b *Bot) ReconcileStale(reqs []approval.Request) {
+	b.replaceMessages(reqs, func(req approval.Request) string {
+		return fmt.Sprintf("⌛ Request %s expired while the server was offline", req.ID)
+	})
+}
+
+// expireMessage replaces the buttons of a request whose deadline passed.
+func (b *Bot) expireMessage(req approval.Request) {
+	b.replaceMessages([]approval.Request{req}, func(req approval.Request) string {
+		if req.Status == approval.StatusAbandoned {
+			return fmt.Sprintf("🔌 Request %s was withdrawn: the client disconnected", req.ID)
+		}
+		return fmt.Sprintf("⌛ Request %s expired without a decision", req.ID)
+	})
+}
+
+// ReconcileCancelled updates the messages of requests cancelled on shutdown.
+func (b *Bot) ReconcileCancelled(reqs []approval.Request) {
+	b.replaceMessages(reqs, func(req approval.Request) string {
+		return fmt.Sprintf("🔁 Request %s was cancelled because the server restarted", req.ID)
+	})
+}
+
+// replaceMessages replaces the text and buttons of each request's message.
+func (b *Bot) replaceMessages(reqs []approval.Request, text func(approval.Request) string) {
+	for _, req := range reqs {
+		if req.MessageID == 0 {
+			continue
+		}
+		edit := tgbotapi.NewEditMessageText(req.ChatID, req.MessageID, text(req))
+		if _, err := b.send(edit); err != nil {
+			log.Printf("Failed to update message for %s: %v", req.ID, err)
+		}
+	}
+}
+
+func (b *Bot) handleCallback(cb *tgbotapi.CallbackQuery) {
+	action, reqID, ok := strings.Cut(cb.Data, ":")
+	if !ok || cb.From == nil || cb.Message == nil {
+		return
+	}
+	volumeIdx := -1
+	switch action {
+	case "approve", "deny":
+	case "toggle":
+		id, idx, ok := strings.Cut(reqID, ":")
+		n, err := strconv.Atoi(idx)
+		if !ok || err != nil {
+			return
+		}
+		reqID, volumeIdx = id, n
+	default:
+		return
+	}
+
+	voter := approval.Voter{ID: cb.From.ID, Name: cb.From.String()}
+	req, _ := b.approvalService.Get(reqID)
+	if !b.currentAccess().canDecide(cb.Message.Chat.ID, voter.ID, req) {
+		log.Printf("Rejected callback from unauthorized user %s (%d) in chat %d for request %s", voter.Name, voter.ID, cb.Message.Chat.ID, reqID)
+		b.recordRejectedVote(reqID, voter, fmt.Sprintf("unauthorized user in chat %d", cb.Message.Chat.ID))
+		b.answerCallback(cb.ID, "⛔ You are not allowed to decide this request")
+		return
 	}
 
-	// Update the message to remove buttons and show status
-	if success {
-		edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, responseText)
-		if _, err := b.api.Send(edit); err != nil {
+	if volumeIdx >= 0 {
+		b.toggleVolume(cb, reqID, volumeIdx, voter)
+		return
+	}
+
+	req, err := b.approvalService.Vote(reqID, voter, action == "approve")
+
+	var responseText string
+	var edit tgbotapi.EditMessageTextConfig
+	switch {
+	case errors.Is(err, approval.ErrNotPending):
+		responseText = "⚠️ Request expired or not found"
+	case err != nil:
+		log.Printf("Rejected vote by %s on request %s: %v", voter.Name, reqID, err)
+		b.recordRejectedVote(reqID, voter, err.Error())
+		responseText = fmt.Sprintf("⚠️ %v", err)
+	case req.Status == approval.StatusApproved:
+		responseText = fmt.Sprintf("✅ Request %s Approved by %s", reqID, req.DeciderNames())
+		if len(req.Volumes) > 0 {
+			responseText += fmt.Sprintf(" for %s", strings.Join(req.SelectedVolumes(), ", "))
+		}
+		edit = tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, responseText)
+	case req.Status == approval.StatusDenied:
+		responseText = fmt.Sprintf("❌ Request %s Denied by %s", reqID, req.DeciderNames())
+		edit = tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, responseText)
+	default:
+		// Still waiting for the quorum: refresh the tally and keep the buttons.
+		responseText = "🗳 Vote recorded"
+		keyboard := approvalKeyboard(req)
+		edit = tgbotapi.NewEditMessageTextAndMarkup(cb.Message.Chat.ID, cb.Message.MessageID, pendingText(req), keyboard)
+		edit.ParseMode = "Markdown"
+	}
+
+	b.answerCallback(cb.ID, responseText)
+
+	// Update the message to show the new status
+	if edit.Text != "" {
+		if _, err := b.send(edit); err != nil {
 			log.Printf("Failed to edit message: %v", err)
 		}
 	}
 }
+
+// toggleVolume includes or excludes a volume of a batch request and
+// refreshes the message.
+func (b *Bot) toggleVolume(cb *tgbotapi.CallbackQuery, reqID string, idx int, voter approval.Voter) {
+	req, err := b.approvalService.ToggleVolume(reqID, idx, voter)
+	switch {
+	case errors.Is(err, approval.ErrNotPending):
+		b.answerCallback(cb.ID, "⚠️ Request expired or not found")
+		return
+	case err != nil:
+		b.answerCallback(cb.ID, fmt.Sprintf("⚠️ %v", err))
+		return
+	}
+	b.answerCallback(cb.ID, "Selection updated")
+
+	edit := tgbotapi.NewEditMessageTextAndMarkup(cb.Message.Chat.ID, cb.Message.MessageID, pendingText(req), approvalKeyboard(req))
+	edit.ParseMode = "Markdown"
+	if _, err := b.send(edit); err != nil {
+		log.Printf("Failed to edit message: %v", err)
+	}
+}
+
+func (b *Bot) recordRejectedVote(reqID string, voter approval.Voter, reason string) {
+	b.auditLog.Record(audit.Event{
+		Type:      audit.EventVoteRejected,
+		RequestID: reqID,
+		Actor:     fmt.Sprintf("%s (%d)", voter.Name, voter.ID),
+		Detail:    reason,
+	})
+}
+
+// answerCallback stops the loading animation on the pressed button.
+func (b *Bot) answerCallback(callbackID, text string) {
+	callbackCfg := tgbotapi.NewCallback(callbackID, text)
+	if _, err := b.api.Request(callbackCfg); err != nil {
+		b.metrics.TelegramSendFailed()
+		log.Printf("Failed to answer callback: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package telegram
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"zfs-unlocker/internal/approval"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// historyLimit caps the number of entries /history returns.
+const historyLimit = 50
+
+// operatorCommands change what gets approved, or list the grants that do,
+// and are limited to operators; the other commands are available to everyone
+// allowed to vote.
+var operatorCommands = map[string]bool{
+	"preapprove": true,
+	"grants":     true,
+	"revoke":     true,
+	"deny_all":   true,
+}
+
+// handleCommand runs a command sent to the approval chat.
+func (b *Bot) handleCommand(msg *tgbotapi.Message) {
+	a := b.currentAccess()
+	if msg.From == nil || msg.Chat == nil || msg.Chat.ID != a.chatID {
+		return
+	}
+	cmd := msg.Command()
+	if !a.canRun(cmd, msg.From.ID) {
+		log.Printf("Rejected /%s from unauthorized user %s (%d)", cmd, msg.From.String(), msg.From.ID)
+		b.reply(msg, "⛔ You are not allowed to run this command")
+		return
+	}
+
+	by := approval.Voter{ID: msg.From.ID, Name: msg.From.String()}
+	args := strings.Fields(msg.CommandArguments())
+	switch cmd {
+	case "pending":
+		b.sendPending(msg)
+	case "status":
+		b.reply(msg, b.status())
+	case "history":
+		b.reply(msg, b.history(args))
+	case "deny_all":
+		b.denyAll(msg, by)
+	case "preapprove":
+		b.reply(msg, b.preapprove(args, by))
+	case "grants":
+		b.reply(msg, b.listGrants())
+	case "revoke":
+		if len(args) != 1 {
+			b.reply(msg, "Usage: /revoke <grant-id>")
+			return
+		}
+		if !b.approvalService.RevokeGrant(args[0], by) {
+			b.reply(msg, fmt.Sprintf("⚠️ No active grant %s", args[0]))
+			return
+		}
+		b.reply(msg, fmt.Sprintf("🗑 Grant %s revoked", args[0]))
+	case "help", "start":
+		b.reply(msg, "Commands:\n"+
+			"/pending - open requests with buttons\n"+
+			"/status - backend health, uptime and version\n"+
+			"/history [n] - recent decisions\n"+
+			"/deny_all - deny every open request\n"+
+			"/preapprove <api-key|host> <volume-glob> <duration> - pre-approve a maintenance window\n"+
+			"/grants - active pre-approvals\n"+
+			"/revoke <grant-id> - cancel a pre-approval")
+	}
+}
+
+// sendPending posts every open request again with its voting buttons. The
+// request moves to the new message, and the old one loses its buttons so
+// that only the message updated on a decision can be voted on.
+func (b *Bot) sendPending(msg *tgbotapi.Message) {
+	pending := b.approvalService.Pending()
+	if len(pending) == 0 {
+		b.reply(msg, "No pending requests")
+		return
+	}
+	for _, req := range pending {
+		out := tgbotapi.NewMessage(msg.Chat.ID, pendingText(req))
+		out.ParseMode = "Markdown"
+		out.ReplyMarkup = approvalKeyboard(req)
+		sent, err := b.send(out)
+		if err != nil {
+			log.Printf("Failed to send pending request %s: %v", req.ID, err)
+			continue
+		}
+		b.approvalService.AttachMessage(req.ID, sent.Chat.ID, sent.MessageID)
+
+		// Leave the old message alone if the request was decided meanwhile;
+		// it then carries the decision.
+		if cur, _ := b.approvalService.Get(req.ID); req.MessageID != 0 && cur.MessageID == sent.MessageID {
+			edit := tgbotapi.NewEditMessageText(req.ChatID, req.MessageID, fmt.Sprintf("↪️ Request %s was reposted below", req.ID))
+			if _, err := b.send(edit); err != nil {
+				log.Printf("Failed to update previous message for %s: %v", req.ID, err)
+			}
+		}
+	}
+}
+
+func (b *Bot) status() string {
+	health := "✅ ok"
+	if b.healthCheck != nil {
+		if err := b.healthCheck(); err != nil {
+			health = fmt.Sprintf("❌ %v", err)
+		}
+	}
+	return fmt.Sprintf("zfs-unlocker %s\nUptime: %s\nSecret backend: %s\nPending requests: %d\nActive grants: %d",
+		b.version, time.Since(b.started).Round(time.Second), health,
+		len(b.approvalService.Pending()), len(b.approvalService.Grants()))
+}
+
+func (b *Bot) history(args []string) string {
+	n := 10
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 1 {
+			return "Usage: /history [n]"
+		}
+		n = min(v, historyLimit)
+	}
+
+	reqs, err := b.approvalService.History(n)
+	if err != nil {
+		log.Printf("Failed to load history: %v", err)
+		return "⚠️ Failed to load history"
+	}
+	if len(reqs) == 0 {
+		return "No decided requests"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Recent decisions:")
+	for _, req := range reqs {
+		fmt.Fprintf(&sb, "\n%s %s %s for %s (%s)", statusMark(req.Status),
+			req.DecidedAt.Format("2006-01-02 15:04"), req.VolumeID, req.APIKey, req.ClientIP)
+		if names := req.DeciderNames(); names != "" {
+			fmt.Fprintf(&sb, " by %s", names)
+		}
+	}
+	return sb.String()
+}
+
+func statusMark(s approval.Status) string {
+	switch s {
+	case approval.StatusApproved:
+		return "✅"
+	case approval.StatusDenied:
+		return "❌"
+	case approval.StatusExpired:
+		return "⌛"
+	case approval.StatusCancelled:
+		return "🔁"
+	case approval.StatusAbandoned:
+		return "🔌"
+	}
+	return "❔"
+}
+
+func (b *Bot) denyAll(msg *tgbotapi.Message, by approval.Voter) {
+	denied := b.approvalService.DenyAll(by)
+	b.replaceMessages(denied, func(req approval.Request) string {
+		return fmt.Sprintf("❌ Request %s Denied by %s (/deny_all)", req.ID, by.Name)
+	})
+	b.reply(msg, fmt.Sprintf("❌ Denied %d pending requests", len(denied)))
+}
+
+func (b *Bot) preapprove(args []string, by approval.Voter) string {
+	const usage = "Usage: /preapprove <api-key|host> <volume-glob> <duration>\nExample: /preapprove server-01 tank-* 2h"
+	if len(args) != 3 {
+		return usage
+	}
+	d, err := time.ParseDuration(args[2])
+	if err != nil {
+		return usage
+	}
+	g, err := b.approvalService.AddGrant(args[0], args[1], d, by)
+	if err != nil {
+		return fmt.Sprintf("⚠️ %v", err)
+	}
+	return fmt.Sprintf("🗓 Grant %s: requests from %s for %s are approved until %s\n"+
+		"Requests needing more than one approval, or whose approvers do not include you, still need a vote.",
+		g.ID, g.Subject, g.Volumes, g.ExpiresAt.Format("2006-01-02 15:04 MST"))
+}
+
+func (b *Bot) listGrants() string {
+	grants := b.approvalService.Grants()
+	if len(grants) == 0 {
+		return "No active grants"
+	}
+	var sb strings.Builder
+	sb.WriteString("Active grants:")
+	for _, g := range grants {
+		fmt.Fprintf(&sb, "\n%s: %s %s until %s (by %s)",
+			g.ID, g.Subject, g.Volumes, g.ExpiresAt.Format("2006-01-02 15:04 MST"), g.CreatedBy.Name)
+	}
+	return sb.String()
+}
+
+// reply answers a command message in the chat it was sent to.
+func (b *Bot) reply(msg *tgbotapi.Message, text string) {
+	out := tgbotapi.NewMessage(msg.Chat.ID, text)
+	out.ReplyToMessageID = msg.MessageID
+	if _, err := b.send(out); err != nil {
+		log.Printf("Failed to reply to /%s: %v", msg.Command(), err)
+	}
+}
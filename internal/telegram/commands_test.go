@@ -0,0 +1,70 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"zfs-unlocker/internal/approval"
+)
+
+func TestAccess_CanRun(t *testing.T) {
+	const voter, admin, stranger = int64(1), int64(2), int64(3)
+	a := access{allowedUsers: []int64{voter}, adminUsers: []int64{admin}}
+
+	for _, cmd := range []string{"deny_all", "preapprove", "grants", "revoke"} {
+		if !operatorCommands[cmd] {
+			t.Errorf("Expected /%s to be an operator command", cmd)
+		}
+	}
+	for cmd := range operatorCommands {
+		if a.canRun(cmd, voter) || a.canRun(cmd, stranger) {
+			t.Errorf("Expected /%s to be refused for non-admins", cmd)
+		}
+		if !a.canRun(cmd, admin) {
+			t.Errorf("Expected /%s to be allowed for admins", cmd)
+		}
+	}
+	for _, cmd := range []string{"pending", "status", "history", "help"} {
+		if !a.canRun(cmd, voter) || !a.canRun(cmd, admin) {
+			t.Errorf("Expected /%s to be allowed for voters and admins", cmd)
+		}
+		if a.canRun(cmd, stranger) {
+			t.Errorf("Expected /%s to be refused for unknown users", cmd)
+		}
+	}
+}
+
+func TestPendingText(t *testing.T) {
+	req := approval.Request{
+		ID:          "req-1",
+		Description: "Batch unlock",
+		Volumes:     []string{"tank-a", "tank-b"},
+		Excluded:    []string{"tank-b"},
+		Policy:      approval.Policy{RequiredApprovals: 2},
+		ExpiresAt:   time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	text := pendingText(req)
+	for _, want := range []string{"`req-1`", "Batch unlock", "Expires: 12:30:00 UTC", "tap to leave one out", "☑️ `tank-a`", "⬜ `tank-b`", "Votes: 0/2 approvals, 0 denials"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in:\n%s", want, text)
+		}
+	}
+
+	req.Votes = []approval.Vote{
+		{Voter: approval.Voter{ID: 1, Name: "alice_a"}, Approve: true},
+		{Voter: approval.Voter{ID: 2, Name: "bob"}, Approve: false},
+	}
+	text = pendingText(req)
+	for _, want := range []string{"fixed once voting started", "Votes: 1/2 approvals, 1 denials", `✅ alice\_a`, "❌ bob"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in:\n%s", want, text)
+		}
+	}
+
+	// Single-approval requests without votes show no tally.
+	if text := pendingText(approval.Request{ID: "req-2", Policy: approval.DefaultPolicy}); strings.Contains(text, "Votes:") || strings.Contains(text, "Volumes") {
+		t.Errorf("Expected no tally or volume list for a plain request, got:\n%s", text)
+	}
+}
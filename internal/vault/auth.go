@@ -0,0 +1,199 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"zfs-unlocker/internal/config"
+
+	hashivault "github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultKubernetesJWT = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// loginRetryInterval is how long to wait before retrying a failed login.
+	loginRetryInterval = 30 * time.Second
+)
+
+var errNotLoggedIn = errors.New("not logged in to Vault yet")
+
+// login authenticates with the configured method and returns the auth secret,
+// or nil if the token cannot be renewed (e.g. a static root token).
+func (v *VaultClient) login(ctx context.Context) (*hashivault.Secret, error) {
+	method := v.auth.Method
+	if method == "" || method == "token" {
+		return v.renewableToken(ctx)
+	}
+
+	mount := v.auth.MountPath
+	if mount == "" {
+		mount = method
+	}
+
+	data := map[string]interface{}{}
+	switch method {
+	case "approle":
+		secretID, err := readTrimmed(v.auth.SecretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AppRole secret ID: %w", err)
+		}
+		data["role_id"] = v.auth.RoleID
+		data["secret_id"] = secretID
+	case "kubernetes":
+		jwtFile := v.auth.JWTFile
+		if jwtFile == "" {
+			jwtFile = defaultKubernetesJWT
+		}
+		jwt, err := readTrimmed(jwtFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account token: %w", err)
+		}
+		data["role"] = v.auth.Role
+		data["jwt"] = jwt
+	case "cert":
+		// The client certificate is presented through the TLS configuration.
+		if v.auth.Role != "" {
+			data["name"] = v.auth.Role
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Vault auth method %q", method)
+	}
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", mount), data)
+	if err != nil {
+		return nil, fmt.Errorf("%s login failed: %w", method, err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("%s login returned no token", method)
+	}
+
+	v.client.SetToken(secret.Auth.ClientToken)
+	log.Printf("Logged in to Vault using %s auth (TTL %ds)", method, secret.Auth.LeaseDuration)
+	return secret, nil
+}
+
+// renewableToken validates a static token and returns a renewable auth
+// secret for it, or nil if the token does not expire or cannot be renewed.
+func (v *VaultClient) renewableToken(ctx context.Context) (*hashivault.Secret, error) {
+	self, err := v.client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("token validation failed: %w", err)
+	}
+
+	renewable, err := self.TokenIsRenewable()
+	if err != nil || !renewable {
+		return nil, nil
+	}
+	return v.client.Auth().Token().RenewSelfWithContext(ctx, 0)
+}
+
+// manageToken keeps the Vault token valid: it renews the token while Vault
+// allows it and logs in again once renewal stops, until ctx is cancelled.
+func (v *VaultClient) manageToken(ctx context.Context) {
+	defer close(v.done)
+
+	for {
+		secret, err := v.login(ctx)
+		if err != nil {
+			v.setAuthErr(err)
+			log.Printf("Vault authentication failed, retrying in %s: %v", loginRetryInterval, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(loginRetryInterval):
+				continue
+			}
+		}
+		v.setAuthErr(nil)
+
+		if secret == nil {
+			// Static token that needs no renewal; nothing left to manage.
+			return
+		}
+
+		if err := v.watch(ctx, secret); err != nil {
+			v.setAuthErr(err)
+			log.Printf("Vault token renewal stopped: %v", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if m := v.auth.Method; m == "" || m == "token" {
+			// A static token cannot be re-issued; keep reporting the failure.
+			v.setAuthErr(errors.New("vault token reached its maximum TTL"))
+			return
+		}
+	}
+}
+
+// watch renews secret until the lifetime watcher gives up or ctx is cancelled.
+func (v *VaultClient) watch(ctx context.Context, secret *hashivault.Secret) error {
+	watcher, err := v.client.NewLifetimeWatcher(&hashivault.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		return fmt.Errorf("failed to start token watcher: %w", err)
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				return err
+			}
+			return errors.New("token is no longer renewable")
+		case renewal := <-watcher.RenewCh():
+			v.setAuthErr(nil)
+			log.Printf("Renewed Vault token at %s", renewal.RenewedAt.Format(time.RFC3339))
+		}
+	}
+}
+
+func (v *VaultClient) setAuthErr(err error) {
+	v.mu.Lock()
+	v.authErr = err
+	v.mu.Unlock()
+}
+
+// AuthHealth returns nil while the client holds a valid token, or the last
+// authentication error otherwise.
+func (v *VaultClient) AuthHealth() error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.authErr
+}
+
+func readTrimmed(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func tlsConfig(cfg config.VaultTLSConfig) *hashivault.TLSConfig {
+	return &hashivault.TLSConfig{
+		CACert:     cfg.CACert,
+		ClientCert: cfg.ClientCert,
+		ClientKey:  cfg.ClientKey,
+	}
+}
+
+// Ping checks that Vault is reachable and the client's token is still valid.
+func (v *VaultClient) Ping(ctx context.Context) error {
+	if err := v.AuthHealth(); err != nil {
+		return err
+	}
+	if _, err := v.client.Auth().Token().LookupSelfWithContext(ctx); err != nil {
+		return fmt.Errorf("token lookup failed: %w", err)
+	}
+	return nil
+}
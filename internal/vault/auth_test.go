@@ -0,0 +1,174 @@
+package vault
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"zfs-unlocker/internal/config"
+)
+
+// loginResponse is a successful login returning token with the given lease.
+func loginResponse(w http.ResponseWriter, token string, lease int, renewable bool) {
+	writeJSON(w, http.StatusOK, map[string]any{"auth": map[string]any{
+		"client_token":   token,
+		"lease_duration": lease,
+		"renewable":      renewable,
+	}})
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLogin_Methods(t *testing.T) {
+	secretIDFile := writeFile(t, "secret-id", "secret-id\n")
+	jwtFile := writeFile(t, "jwt", "service-account-jwt\n")
+
+	for _, tt := range []struct {
+		name string
+		auth config.VaultAuthConfig
+		path string
+		want map[string]any
+	}{
+		{"approle", config.VaultAuthConfig{Method: "approle", RoleID: "role-id", SecretIDFile: secretIDFile},
+			"/v1/auth/approle/login", map[string]any{"role_id": "role-id", "secret_id": "secret-id"}},
+		{"kubernetes", config.VaultAuthConfig{Method: "kubernetes", MountPath: "k8s", Role: "zfs", JWTFile: jwtFile},
+			"/v1/auth/k8s/login", map[string]any{"role": "zfs", "jwt": "service-account-jwt"}},
+		{"cert", config.VaultAuthConfig{Method: "cert", Role: "zfs-unlocker"},
+			"/v1/auth/cert/login", map[string]any{"name": "zfs-unlocker"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var token atomic.Value
+			addr := fakeVault(t, map[string]http.HandlerFunc{
+				tt.path: func(w http.ResponseWriter, r *http.Request) {
+					body := readBody(r)
+					for k, want := range tt.want {
+						if body[k] != want {
+							writeJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{"bad " + k}})
+							return
+						}
+					}
+					loginResponse(w, "s."+tt.name, 3600, false)
+				},
+				"/v1/secret/data/server-01/tank": func(w http.ResponseWriter, r *http.Request) {
+					token.Store(r.Header.Get("X-Vault-Token"))
+					writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"data": map[string]any{"key": "a2V5"}}})
+				},
+			})
+			v := newTestClient(t, config.VaultConfig{Address: addr, MountPath: "secret", Auth: tt.auth})
+
+			waitFor(t, "login", func() bool { return v.AuthHealth() == nil })
+			if _, err := v.GetSecret(t.Context(), "server-01", "tank"); err != nil {
+				t.Fatalf("GetSecret failed: %v", err)
+			}
+			if got := token.Load(); got != "s."+tt.name {
+				t.Errorf("Expected reads to use the login token, got %v", got)
+			}
+		})
+	}
+}
+
+func TestLogin_Failure(t *testing.T) {
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{"invalid secret id"}})
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Auth: config.VaultAuthConfig{
+		Method: "approle", RoleID: "role-id", SecretIDFile: writeFile(t, "secret-id", "wrong"),
+	}})
+
+	waitFor(t, "the login to fail", func() bool {
+		err := v.AuthHealth()
+		return err != nil && !errors.Is(err, errNotLoggedIn)
+	})
+	if err := v.AuthHealth(); !strings.Contains(err.Error(), "approle login failed") {
+		t.Errorf("Expected the login error to be reported, got %v", err)
+	}
+
+	missing := newTestClient(t, config.VaultConfig{Address: addr, Auth: config.VaultAuthConfig{
+		Method: "approle", RoleID: "role-id", SecretIDFile: filepath.Join(t.TempDir(), "missing"),
+	}})
+	waitFor(t, "the secret ID read to fail", func() bool {
+		err := missing.AuthHealth()
+		return err != nil && strings.Contains(err.Error(), "secret ID")
+	})
+}
+
+func TestLogin_StaticToken(t *testing.T) {
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/token/lookup-self": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "good" {
+				writeJSON(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"renewable": false}})
+		},
+	})
+
+	good := newTestClient(t, config.VaultConfig{Address: addr, Token: "good"})
+	waitFor(t, "the token to be validated", func() bool { return good.AuthHealth() == nil })
+
+	bad := newTestClient(t, config.VaultConfig{Address: addr, Token: "bad"})
+	waitFor(t, "the token to be rejected", func() bool {
+		err := bad.AuthHealth()
+		return err != nil && strings.Contains(err.Error(), "token validation failed")
+	})
+}
+
+func TestAuthHealth_NotLoggedIn(t *testing.T) {
+	release := make(chan struct{})
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/cert/login": func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			loginResponse(w, "s.cert", 3600, false)
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Auth: config.VaultAuthConfig{Method: "cert"}})
+
+	if err := v.AuthHealth(); !errors.Is(err, errNotLoggedIn) {
+		t.Errorf("Expected errNotLoggedIn before the login completes, got %v", err)
+	}
+	if err := v.Ping(t.Context()); !errors.Is(err, errNotLoggedIn) {
+		t.Errorf("Expected Ping to report errNotLoggedIn, got %v", err)
+	}
+	close(release)
+	waitFor(t, "login", func() bool { return v.AuthHealth() == nil })
+}
+
+func TestManageToken_RenewsThenLogsInAgain(t *testing.T) {
+	var logins, renewals atomic.Int32
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/approle/login": func(w http.ResponseWriter, r *http.Request) {
+			logins.Add(1)
+			loginResponse(w, "s.approle", 2, true)
+		},
+		// The first renewal succeeds; after that Vault refuses, so the client
+		// has to log in anew before the token expires.
+		"/v1/auth/token/renew-self": func(w http.ResponseWriter, r *http.Request) {
+			if renewals.Add(1) > 1 {
+				writeJSON(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+				return
+			}
+			loginResponse(w, "s.approle", 1, true)
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Auth: config.VaultAuthConfig{
+		Method: "approle", RoleID: "role-id", SecretIDFile: writeFile(t, "secret-id", "secret-id"),
+	}})
+
+	// The client is healthy again once the new login has completed.
+	waitFor(t, "a renewal followed by a new login", func() bool {
+		return renewals.Load() >= 1 && logins.Load() >= 2 && v.AuthHealth() == nil
+	})
+}
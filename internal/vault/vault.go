@@ -3,6 +3,9 @@ package vault
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"zfs-unlocker/internal/config"
 
@@ -13,16 +16,50 @@ type Client interface {
 	GetSecret(ctx context.Context, keyPrefix, volumeID string) (map[string]interface{}, error)
 }
 
+// ValidSegment reports whether s is safe as a single component of a secret
+// path, such as a volume ID: not empty, not "." or "..", and free of path
+// separators, so it cannot reach secrets outside its key prefix.
+func ValidSegment(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`) && filepath.Base(s) == s
+}
+
+// VersionedClient is implemented by backends that can return older versions of a secret.
+type VersionedClient interface {
+	GetSecretVersion(ctx context.Context, keyPrefix, volumeID string, version int) (map[string]interface{}, error)
+}
+
 type VaultClient struct {
 	client     *hashivault.Client
 	mountPath  string
 	secretPath string
+	kvVersion  int
+	auth       config.VaultAuthConfig
+
+	// Transit key used to decrypt stored keys; empty if keys are stored in plaintext.
+	transitMount string
+	transitKey   string
+
+	mu      sync.RWMutex
+	authErr error
+	stop    context.CancelFunc
+	done    chan struct{}
 }
 
 func New(cfg config.VaultConfig) (*VaultClient, error) {
+	switch cfg.Auth.Method {
+	case "", "token", "approle", "kubernetes", "cert":
+	default:
+		return nil, fmt.Errorf("unsupported Vault auth method %q", cfg.Auth.Method)
+	}
+
 	vConfig := hashivault.DefaultConfig()
 
 	vConfig.Address = cfg.Address
+	if cfg.TLS != (config.VaultTLSConfig{}) {
+		if err := vConfig.ConfigureTLS(tlsConfig(cfg.TLS)); err != nil {
+			return nil, fmt.Errorf("unable to configure Vault TLS: %w", err)
+		}
+	}
 
 	client, err := hashivault.NewClient(vConfig)
 	if err != nil {
@@ -34,20 +71,51 @@ func New(cfg config.VaultConfig) (*VaultClient, error) {
 		client.SetToken(cfg.Token)
 	}
 
-	// Verify connection/token (optional, but good practice)
-	// _, err = client.Auth().Token().LookupSelf()
-	// if err != nil {
-	// 	 return nil, fmt.Errorf("token validation failed: %w", err)
-	// }
+	if cfg.KVVersion != 0 && cfg.KVVersion != 1 && cfg.KVVersion != 2 {
+		return nil, fmt.Errorf("unsupported KV version %d", cfg.KVVersion)
+	}
+	if cfg.Transit.MountPath == "" {
+		cfg.Transit.MountPath = "transit"
+	}
 
-	return &VaultClient{
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &VaultClient{
 		client:     client,
 		mountPath:  cfg.MountPath,
 		secretPath: cfg.SecretPath,
-	}, nil
+		kvVersion:  cfg.KVVersion,
+		auth:       cfg.Auth,
+
+		transitMount: cfg.Transit.MountPath,
+		transitKey:   cfg.Transit.Key,
+		authErr:      errNotLoggedIn,
+		stop:         cancel,
+		done:         make(chan struct{}),
+	}
+
+	// Log in (or validate the static token) and keep the token renewed in the background.
+	go v.manageToken(ctx)
+
+	return v, nil
+}
+
+// Close stops the background token renewal.
+func (v *VaultClient) Close() {
+	v.stop()
+	<-v.done
 }
 
 func (v *VaultClient) GetSecret(ctx context.Context, keyPrefix, volumeID string) (map[string]interface{}, error) {
+	return v.GetSecretVersion(ctx, keyPrefix, volumeID, 0)
+}
+
+// GetSecretVersion reads a specific version of a secret; version 0 means the latest.
+// Pinning a version requires a KV-v2 mount.
+func (v *VaultClient) GetSecretVersion(ctx context.Context, keyPrefix, volumeID string, version int) (map[string]interface{}, error) {
+	if !ValidSegment(volumeID) {
+		return nil, fmt.Errorf("invalid volume ID %q", volumeID)
+	}
+
 	// Path construction: {vault-config-prefix}/{api-key-config-prefix}/{volume-id}
 	// e.g. secret/data/my-secret/key-prefix/volume-id
 	// Note: KVv2 Get argument is relative to the mount.
@@ -58,7 +126,18 @@ func (v *VaultClient) GetSecret(ctx context.Context, keyPrefix, volumeID string)
 	// Clean up double slashes if any prefix is empty
 	// (Simple string manip or path.Join, but path.Join might mess with URL schemes if any, keeping simple for now)
 
-	secret, err := v.client.KVv2(v.mountPath).Get(ctx, fullPath)
+	var secret *hashivault.KVSecret
+	var err error
+	switch {
+	case v.kvVersion == 1 && version > 0:
+		return nil, fmt.Errorf("secret versions require a KV-v2 mount")
+	case v.kvVersion == 1:
+		secret, err = v.client.KVv1(v.mountPath).Get(ctx, fullPath)
+	case version > 0:
+		secret, err = v.client.KVv2(v.mountPath).GetVersion(ctx, fullPath, version)
+	default:
+		secret, err = v.client.KVv2(v.mountPath).Get(ctx, fullPath)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to read secret at %s: %w", fullPath, err)
 	}
@@ -66,6 +145,40 @@ func (v *VaultClient) GetSecret(ctx context.Context, keyPrefix, volumeID string)
 	if secret == nil {
 		return nil, fmt.Errorf("secret not found at %s/%s", v.mountPath, fullPath)
 	}
+	// KV-v2 returns the metadata but no data for deleted and destroyed versions.
+	if secret.Data == nil {
+		return nil, fmt.Errorf("secret at %s/%s was deleted or destroyed", v.mountPath, fullPath)
+	}
 
+	if v.transitKey != "" {
+		return v.decryptKey(ctx, secret.Data)
+	}
 	return secret.Data, nil
 }
+
+// decryptKey replaces the Transit ciphertext in the "key" field with its
+// plaintext, which Transit returns Base64 encoded like a regular stored key.
+func (v *VaultClient) decryptKey(ctx context.Context, data map[string]interface{}) (map[string]interface{}, error) {
+	ciphertext, ok := data["key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret has no Transit ciphertext in its key field")
+	}
+
+	path := fmt.Sprintf("%s/decrypt/%s", v.transitMount, v.transitKey)
+	resp, err := v.client.Logical().WriteWithContext(ctx, path, map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transit decryption failed: %w", err)
+	}
+	if resp == nil || resp.Data["plaintext"] == nil {
+		return nil, fmt.Errorf("transit decryption returned no plaintext")
+	}
+
+	decrypted := make(map[string]interface{}, len(data))
+	for k, val := range data {
+		decrypted[k] = val
+	}
+	decrypted["key"] = resp.Data["plaintext"]
+	return decrypted, nil
+}
@@ -0,0 +1,209 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zfs-unlocker/internal/config"
+)
+
+// fakeVault serves the given handlers by request path. Unknown paths get a
+// 404, and a static token is accepted unless a handler overrides lookup-self.
+func fakeVault(t *testing.T, routes map[string]http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := routes[r.URL.Path]; ok {
+			h(w, r)
+			return
+		}
+		if r.URL.Path == "/v1/auth/token/lookup-self" {
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"renewable": false}})
+			return
+		}
+		writeJSON(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readBody decodes a JSON request body.
+func readBody(r *http.Request) map[string]any {
+	body := map[string]any{}
+	json.NewDecoder(r.Body).Decode(&body)
+	return body
+}
+
+func newTestClient(t *testing.T, cfg config.VaultConfig) *VaultClient {
+	t.Helper()
+	v, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(v.Close)
+	return v
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetSecret_KVv2(t *testing.T) {
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/secret/data/zfs/server-01/tank": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{
+				"data":     map[string]any{"key": "c2VjcmV0"},
+				"metadata": map[string]any{"version": 2},
+			}})
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Token: "t", MountPath: "secret", SecretPath: "zfs"})
+
+	data, err := v.GetSecret(context.Background(), "server-01", "tank")
+	if err != nil || data["key"] != "c2VjcmV0" {
+		t.Fatalf("Expected the stored key, got %v (err %v)", data, err)
+	}
+	if _, err := v.GetSecret(context.Background(), "server-01", "missing"); err == nil {
+		t.Error("Expected an error for a missing secret")
+	}
+}
+
+func TestGetSecret_KVv1(t *testing.T) {
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/kv/zfs/server-01/tank": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"key": "c2VjcmV0"}})
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Token: "t", MountPath: "kv", SecretPath: "zfs", KVVersion: 1})
+
+	data, err := v.GetSecret(context.Background(), "server-01", "tank")
+	if err != nil || data["key"] != "c2VjcmV0" {
+		t.Fatalf("Expected the stored key, got %v (err %v)", data, err)
+	}
+	if _, err := v.GetSecretVersion(context.Background(), "server-01", "tank", 2); err == nil {
+		t.Error("Expected pinned versions to be rejected on a KV-v1 mount")
+	}
+}
+
+func TestGetSecretVersion(t *testing.T) {
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/secret/data/zfs/server-01/tank": func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Query().Get("version") {
+			case "3":
+				writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{
+					"data":     map[string]any{"key": "djM="},
+					"metadata": map[string]any{"version": 3},
+				}})
+			case "4":
+				writeJSON(w, http.StatusNotFound, map[string]any{"data": map[string]any{
+					"data":     nil,
+					"metadata": map[string]any{"version": 4, "destroyed": true},
+				}})
+			default:
+				writeJSON(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+			}
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Token: "t", MountPath: "secret", SecretPath: "zfs"})
+
+	data, err := v.GetSecretVersion(context.Background(), "server-01", "tank", 3)
+	if err != nil || data["key"] != "djM=" {
+		t.Fatalf("Expected version 3, got %v (err %v)", data, err)
+	}
+	for _, version := range []int{4, 5} {
+		if data, err := v.GetSecretVersion(context.Background(), "server-01", "tank", version); err == nil {
+			t.Errorf("Expected an error for version %d, got %v", version, data)
+		}
+	}
+}
+
+func TestGetSecret_Transit(t *testing.T) {
+	secret := func(key any) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			data := map[string]any{"keyformat": "raw"}
+			if key != nil {
+				data["key"] = key
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": 1}}})
+		}
+	}
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/secret/data/zfs/server-01/tank":   secret("vault:v1:Y2lwaGVy"),
+		"/v1/secret/data/zfs/server-01/bad":    secret("vault:v1:garbage"),
+		"/v1/secret/data/zfs/server-01/no-key": secret(nil),
+		"/v1/transit/decrypt/zfs": func(w http.ResponseWriter, r *http.Request) {
+			if readBody(r)["ciphertext"] != "vault:v1:Y2lwaGVy" {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{"invalid ciphertext"}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"plaintext": "c2VjcmV0"}})
+		},
+	})
+	v := newTestClient(t, config.VaultConfig{
+		Address: addr, Token: "t", MountPath: "secret", SecretPath: "zfs",
+		Transit: config.TransitConfig{Key: "zfs"},
+	})
+
+	data, err := v.GetSecret(context.Background(), "server-01", "tank")
+	if err != nil || data["key"] != "c2VjcmV0" || data["keyformat"] != "raw" {
+		t.Fatalf("Expected the decrypted key alongside the other fields, got %v (err %v)", data, err)
+	}
+	if _, err := v.GetSecret(context.Background(), "server-01", "bad"); err == nil || !strings.Contains(err.Error(), "transit decryption failed") {
+		t.Errorf("Expected bad ciphertext to fail decryption, got %v", err)
+	}
+	if _, err := v.GetSecret(context.Background(), "server-01", "no-key"); err == nil {
+		t.Error("Expected a secret without ciphertext to be rejected")
+	}
+}
+
+func TestGetSecret_InvalidVolumeID(t *testing.T) {
+	requests := 0
+	addr := fakeVault(t, map[string]http.HandlerFunc{
+		"/v1/secret/data/zfs/other": func(w http.ResponseWriter, r *http.Request) { requests++ },
+	})
+	v := newTestClient(t, config.VaultConfig{Address: addr, Token: "t", MountPath: "secret", SecretPath: "zfs"})
+
+	if _, err := v.GetSecret(context.Background(), "server-01", "../other"); err == nil {
+		t.Error("Expected a volume ID with a path separator to be rejected")
+	}
+	if requests != 0 {
+		t.Error("Expected no request to Vault for an invalid volume ID")
+	}
+}
+
+func TestValidSegment(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want bool
+	}{
+		{"tank-secure", true},
+		{"tank.v2", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"tank/secure", false},
+		{`tank\secure`, false},
+	} {
+		if got := ValidSegment(tt.s); got != tt.want {
+			t.Errorf("ValidSegment(%q): expected %v, got %v", tt.s, tt.want, got)
+		}
+	}
+}